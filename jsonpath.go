@@ -1,14 +1,21 @@
 package jsonpath
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"go/token"
-	"go/types"
+	"io"
+	"math"
+	"math/big"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 var ErrGetFromNullObj = errors.New("get attribute from null object")
@@ -17,8 +24,55 @@ var NotMap = errors.New("object is not map")
 var NotSlice = errors.New("object is not slice")
 var IsNull = errors.New("object is nil")
 
-func Get(obj interface{}, path string) (*Result, error) {
-	c, err := Compile(path)
+// ErrNotFound is wrapped by the errors of lookups that matched nothing, like a
+// missing key or an index out of range.
+var ErrNotFound = errors.New("no match")
+
+// ErrTypeMismatch is wrapped by failures to compare or convert a value of the
+// wrong type. In a filter expression it is only returned by LookupStrict: the
+// other lookups treat the element as not matching.
+var ErrTypeMismatch = errors.New("operands of comparison have mismatched types")
+
+// ErrInvalidPath is wrapped by every syntax error returned by Compile, so that a
+// malformed path can be told apart from a failed lookup with errors.Is.
+var ErrInvalidPath = errors.New("invalid path")
+
+// ErrTooManyNodes is returned when a lookup visits more nodes than allowed by
+// MaxNodes.
+var ErrTooManyNodes = errors.New("too many nodes visited")
+
+// RangeMode controls how out-of-range bounds of a slice expression such as
+// `[0:100]` are handled.
+type RangeMode int
+
+const (
+	// RangeStrict returns a no-match error when a bound is out of range.
+	RangeStrict RangeMode = iota
+	// RangeClamp clamps out-of-range bounds to the array, so `[0:100]`
+	// yields every available element and `[-100:]` starts from index 0.
+	RangeClamp
+)
+
+// RangeBounds is the RangeMode used by all range lookups. Defaults to RangeStrict.
+var RangeBounds = RangeStrict
+
+// Get compiles path and looks it up in obj. Matched values are returned as they
+// are stored in obj, see Compiled.Lookup for when they share memory with it.
+func Get(obj interface{}, path string, opts ...Option) (*Result, error) {
+	if paths := coalescedPaths(path); paths != nil {
+		value, isArray, found, err := lookupCoalesced(obj, paths, opts...)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: none of %s resolves to a value", ErrNotFound, path)
+		}
+		return &Result{
+			value:   value,
+			isArray: isArray,
+		}, nil
+	}
+	c, err := Compile(path, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -32,14 +86,366 @@ func Get(obj interface{}, path string) (*Result, error) {
 	}, nil
 }
 
-func Set(obj interface{}, jpath string, val interface{}) error {
-	c, err := Compile(jpath)
+// GetCopy works like Get, but returns a deep copy of the matched value, so that
+// mutating the result does not change obj. Maps and slices are copied, other
+// values such as structs are copied by value.
+func GetCopy(obj interface{}, path string, opts ...Option) (*Result, error) {
+	res, err := Get(obj, path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	res.value = deepCopy(res.value)
+	return res, nil
+}
+
+func deepCopy(obj interface{}) interface{} {
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			res[key] = deepCopy(value)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, value := range v {
+			res[i] = deepCopy(value)
+		}
+		return res
+	}
+	if obj == nil {
+		return nil
+	}
+	v := reflect.ValueOf(obj)
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			return obj
+		}
+		res := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, kv := range v.MapKeys() {
+			res.SetMapIndex(kv, copyValue(v.MapIndex(kv), v.Type().Elem()))
+		}
+		return res.Interface()
+	case reflect.Slice:
+		if v.IsNil() {
+			return obj
+		}
+		res := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			res.Index(i).Set(copyValue(v.Index(i), v.Type().Elem()))
+		}
+		return res.Interface()
+	}
+	return obj
+}
+
+// copyValue deep copies v into a value of type typ.
+func copyValue(v reflect.Value, typ reflect.Type) reflect.Value {
+	copied := deepCopy(v.Interface())
+	if copied == nil {
+		return reflect.Zero(typ)
+	}
+	return reflect.ValueOf(copied)
+}
+
+// DepthMatch is a value matched by GetAllWithDepth.
+type DepthMatch struct {
+	// Path is the concrete path of the value, e.g. `$.store.book[0].price`
+	Path string
+	// Depth is the nesting level of the value: 0 for members of the root, 1
+	// for their members and so on, counting array elements as a level
+	Depth int
+	Value interface{}
+}
+
+// GetAllWithDepth returns every value matched by path in document order,
+// along with its concrete path and the nesting level it was found at. This is
+// mostly useful with recursive descent, e.g. `$..price`.
+func GetAllWithDepth(obj interface{}, path string) ([]DepthMatch, error) {
+	c, err := Compile(path)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]DepthMatch, 0)
+	err = c.walk(obj, func(path string, depth int, value interface{}) error {
+		res = append(res, DepthMatch{Path: path, Depth: depth - 1, Value: value})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// LookupRelative evaluates a `@`-rooted path such as `@.book[0].title` against
+// node, which may be any sub-node of a document instead of its root. Unlike the
+// relative paths of filters it supports ranges and filters as well.
+func LookupRelative(node interface{}, relativePath string) (*Result, error) {
+	if !strings.HasPrefix(relativePath, "@") {
+		return nil, fmt.Errorf("relative path should start with '@'")
+	}
+	c, err := Compile(relativePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.operations) == 0 {
+		return &Result{value: node}, nil
+	}
+	value, isArray, err := c.Lookup(node)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{
+		value:   value,
+		isArray: isArray,
+	}, nil
+}
+
+// Project reshapes obj into a new object: each key of template is set to the
+// value its path resolves to in obj, e.g.
+// {"name": "$.store.book[0].title", "cost": "$.store.book[0].price"}.
+// Paths that aren't found in obj are set to nil, or left out if omitMissing is
+// set. Other errors, like an invalid path or ErrTooManyNodes, are returned.
+//
+// A path can list alternatives separated by `|`, like
+// `$.user.displayName | $.user.name`, to take the value of the first one that
+// resolves to a non-null value.
+func Project(obj interface{}, template map[string]string, omitMissing bool, opts ...Option) (map[string]interface{}, error) {
+	res := make(map[string]interface{}, len(template))
+	for key, path := range template {
+		if paths := coalescedPaths(path); paths != nil {
+			value, _, found, err := lookupCoalesced(obj, paths, opts...)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				res[key] = value
+			} else if !omitMissing {
+				res[key] = nil
+			}
+			continue
+		}
+		c, err := Compile(path, opts...)
+		if err != nil {
+			return nil, err
+		}
+		value, _, err := c.Lookup(obj)
+		if err != nil {
+			if !isNotFound(err) {
+				return nil, err
+			}
+			if !omitMissing {
+				res[key] = nil
+			}
+			continue
+		}
+		res[key] = value
+	}
+	return res, nil
+}
+
+// isNotFound reports whether err of a lookup means that the path matched
+// nothing, like a missing key, an index out of range or a null intermediate.
+func isNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrGetFromNullObj)
+}
+
+// coalescedPaths splits a path like `$.user.displayName | $.user.name` into its
+// alternatives, or returns nil if path has a single one.
+func coalescedPaths(path string) []string {
+	if strings.IndexByte(path, '|') < 0 {
+		return nil
+	}
+	var paths []string
+	depth, start, quoted := 0, 0, false
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '\\':
+			i++
+		case '\'':
+			quoted = !quoted
+		case '[':
+			if !quoted {
+				depth++
+			}
+		case ']':
+			if !quoted && depth > 0 {
+				depth--
+			}
+		case '|':
+			if !quoted && depth == 0 {
+				paths = append(paths, strings.TrimSpace(path[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if paths == nil {
+		return nil
+	}
+	return append(paths, strings.TrimSpace(path[start:]))
+}
+
+// lookupCoalesced returns the value of the first of paths that resolves to a
+// non-null value. Paths that aren't found are skipped, other errors are
+// returned.
+func lookupCoalesced(obj interface{}, paths []string, opts ...Option) (value interface{}, isArray bool, found bool, err error) {
+	for _, path := range paths {
+		c, err := Compile(path, opts...)
+		if err != nil {
+			return nil, false, false, err
+		}
+		value, isArray, err := c.Lookup(obj)
+		if err != nil && !isNotFound(err) {
+			return nil, false, false, err
+		}
+		if err == nil && value != nil {
+			return value, isArray, true, nil
+		}
+	}
+	return nil, false, false, nil
+}
+
+// SortBy looks up path, which should match an array, and returns its elements
+// stably sorted by the value of byPath, a path relative to each element like
+// `@.price`. Values are ordered like the comparisons of filters: numbers
+// numerically and strings lexically. Elements byPath doesn't resolve on are put
+// last in either direction.
+func SortBy(obj interface{}, path, byPath string, asc bool) ([]interface{}, error) {
+	res, err := Get(obj, path)
+	if err != nil {
+		return nil, err
+	}
+	v := reflect.ValueOf(res.value)
+	if res.value == nil || v.Kind() != reflect.Slice {
+		return nil, NotSlice
+	}
+	type item struct {
+		value interface{}
+		key   interface{}
+		found bool
+	}
+	items := make([]item, v.Len())
+	for i := range items {
+		items[i].value = v.Index(i).Interface()
+		key, err := getByPath(items[i].value, obj, byPath)
+		items[i].key, items[i].found = key, err == nil && key != nil
+	}
+	less := "<"
+	if !asc {
+		less = ">"
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if !items[i].found || !items[j].found {
+			return items[i].found && !items[j].found
+		}
+		ok, _ := compare(items[i].key, items[j].key, less)
+		return ok
+	})
+	sorted := make([]interface{}, len(items))
+	for i, it := range items {
+		sorted[i] = it.value
+	}
+	return sorted, nil
+}
+
+// GetFromReader decodes a json document from r and looks up path in it.
+// Numbers are decoded as json.Number to keep their precision.
+func GetFromReader(r io.Reader, path string) (*Result, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var obj interface{}
+	if err := decoder.Decode(&obj); err != nil {
+		return nil, err
+	}
+	return Get(obj, path)
+}
+
+func Set(obj interface{}, jpath string, val interface{}, opts ...Option) error {
+	c, err := Compile(jpath, opts...)
 	if err != nil {
 		return err
 	}
 	return c.Set(obj, val)
 }
 
+// GetMatchingKeys applies the trailing filter of path to a map and returns the
+// keys of the matching entries, e.g. `$.store[?(@.price > 15)]` => ["bicycle"].
+func GetMatchingKeys(obj interface{}, path string) ([]string, error) {
+	c, err := Compile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.operations) == 0 {
+		return nil, fmt.Errorf("path should end with a filter")
+	}
+	last := c.operations[len(c.operations)-1]
+	if last.op != "filter" {
+		return nil, fmt.Errorf("path should end with a filter")
+	}
+	sub := Compiled{operations: c.operations[0 : len(c.operations)-1]}
+	parent, err := sub._Lookup(obj)
+	if err != nil {
+		return nil, err
+	}
+	if len(last.key) > 0 {
+		parent, err = _getByKey(parent, last.key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return getFilteredKeys(parent, obj, last.args.(string))
+}
+
+// Entry is a key/value pair of an object, as returned by GetEntries.
+type Entry struct {
+	Key   string
+	Value interface{}
+}
+
+// GetEntries returns the key/value pairs of the object path points to, sorted
+// by key. A trailing wildcard such as `$.store.bicycle.*` enumerates the members
+// of its parent. Arrays are enumerated with their indices as keys.
+func GetEntries(obj interface{}, path string) ([]Entry, error) {
+	c, err := Compile(path)
+	if err != nil {
+		return nil, err
+	}
+	operations := c.operations
+	if len(operations) > 0 && operations[len(operations)-1].op == "scan" {
+		operations = operations[0 : len(operations)-1]
+	}
+	sub := Compiled{operations: operations, opts: c.opts}
+	target, err := sub._Lookup(obj)
+	if err != nil {
+		return nil, err
+	}
+	if reflect.TypeOf(target) == nil {
+		return nil, IsNull
+	}
+
+	v := reflect.ValueOf(target)
+	switch v.Kind() {
+	case reflect.Map:
+		entries := make([]Entry, 0, v.Len())
+		for _, kv := range v.MapKeys() {
+			entries = append(entries, Entry{Key: mapKeyString(kv), Value: v.MapIndex(kv).Interface()})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Key < entries[j].Key
+		})
+		return entries, nil
+	case reflect.Slice:
+		entries := make([]Entry, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			entries = append(entries, Entry{Key: strconv.Itoa(i), Value: v.Index(i).Interface()})
+		}
+		return entries, nil
+	default:
+		return nil, NotJSON
+	}
+}
+
 func TranslatePath(obj interface{}, path string) (string, error) {
 	compiled, err := Compile(path)
 	if err != nil {
@@ -56,6 +462,152 @@ type Compiled struct {
 	path       string
 	operations []operation
 	step       int
+	opts       options
+}
+
+type options struct {
+	caseInsensitive bool
+	delimiter       byte
+	numericKeys     bool
+	disallowScan    bool
+	noImplicitArray bool
+	// strict is set by LookupStrict
+	strict bool
+	// errs collects the errors of skipped elements, see LookupWithErrorsCollected
+	errs     *[]error
+	maxNodes int
+	// floatTolerance is the tolerance of `==` and `!=` between numbers in
+	// filters
+	floatTolerance float64
+	// numbersAsFloat64 and growArrays configure Set
+	numbersAsFloat64 bool
+	growArrays       bool
+	// arrayMerge and onDuplicate configure Merge and Unflatten
+	arrayMerge  ArrayMergeMode
+	onDuplicate DuplicatePathPolicy
+}
+
+// Option configures how a path is compiled, looked up and set.
+type Option func(o *options)
+
+func newOptions(opts []Option) options {
+	o := options{delimiter: '.'}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithDelimiter separates the keys of the path with delimiter instead of '.',
+// e.g. `$/store/book/0/title` with '/'. Brackets and filters are unchanged,
+// and filters keep using '.' in their own paths. As in slash-separated paths
+// a numeric segment like `0` indexes into an array, see NumericKeysAsIndex.
+func WithDelimiter(delimiter byte) Option {
+	return func(o *options) {
+		o.delimiter = delimiter
+		if delimiter != '.' {
+			o.numericKeys = true
+		}
+	}
+}
+
+// NumericKeysAsIndex makes a bare numeric key such as the `0` of `$.0.name`
+// index into an array when the value it applies to is an array. Maps are still
+// looked up by the key "0".
+func NumericKeysAsIndex() Option {
+	return func(o *options) {
+		o.numericKeys = true
+	}
+}
+
+// DisallowScan makes Compile reject paths using recursive descent, like
+// `$..author` or a trailing `.*`, to bound the cost of untrusted queries.
+func DisallowScan() Option {
+	return func(o *options) {
+		o.disallowScan = true
+	}
+}
+
+// DisallowImplicitDescent makes applying a key to an array, like the `.price`
+// of `$.store.book.price`, fail instead of applying the key to every element.
+// The elements of an array must then be selected explicitly with `[*]`, `[n]`,
+// a slice or a filter, e.g. `$.store.book[*].price`.
+func DisallowImplicitDescent() Option {
+	return func(o *options) {
+		o.noImplicitArray = true
+	}
+}
+
+// errImplicitArray is returned for a key applied to an array with
+// DisallowImplicitDescent.
+var errImplicitArray = errors.New("expected object, got array")
+
+func implicitArrayError(key string) error {
+	return fmt.Errorf("%w at %s; use [*] or [n]", errImplicitArray, key)
+}
+
+// MaxNodes aborts a lookup with ErrTooManyNodes once it has visited more than n
+// nodes, to bound the cost of broad queries like `$..name` or `$.items[*].id`
+// over large documents. Every node a lookup or a recursive descent steps into
+// counts, whether it matches or not.
+func MaxNodes(n int) Option {
+	return func(o *options) {
+		o.maxNodes = n
+	}
+}
+
+// visit counts a visited node against the MaxNodes budget. visited is the count
+// of the current lookup, so that concurrent lookups don't share it.
+func (c *Compiled) visit(visited *int) error {
+	*visited++
+	if c.opts.maxNodes > 0 && *visited > c.opts.maxNodes {
+		return fmt.Errorf("%w: more than %d", ErrTooManyNodes, c.opts.maxNodes)
+	}
+	return nil
+}
+
+// FloatTolerance makes `==` and `!=` in filters consider two numbers equal if
+// they differ by at most eps, so that `@.value == 0.1` matches a computed
+// 0.1+0.2-0.2. It applies to `in` and `contains` as well. Without it numbers
+// are compared exactly.
+func FloatTolerance(eps float64) Option {
+	return func(o *options) {
+		o.floatTolerance = eps
+	}
+}
+
+// NumbersAsFloat64 makes Set store numbers as float64, like encoding/json
+// decodes them, so that a document stays deep-equal to its decoded json after
+// `Set(data, "$.count", 5, NumbersAsFloat64())`. Without it values are stored
+// as is.
+func NumbersAsFloat64() Option {
+	return func(o *options) {
+		o.numbersAsFloat64 = true
+	}
+}
+
+// GrowArrays makes Set extend an array to reach an index beyond its end, as in
+// `Set(data, "$.arr[5]", v, GrowArrays())` on a shorter arr: the elements in
+// between are filled with nil, or the zero value of a typed slice. A grown
+// slice is a new slice, so it is written back to the object holding it, which
+// must be a map or a pointer to a struct; the root array of `$[5]` cannot grow.
+// Without it Set fails on an index out of range.
+func GrowArrays() Option {
+	return func(o *options) {
+		o.growArrays = true
+	}
+}
+
+// CaseInsensitive makes key lookups ignore case. An exact match is always tried
+// first; if no key matches exactly and several keys only differ by case, the
+// lookup fails as ambiguous instead of picking one of them.
+//
+// It only applies to the keys of the path itself: the paths inside a filter,
+// like the `@.name` of `$.list[?(@.name == 'x')]`, are still matched exactly.
+func CaseInsensitive() Option {
+	return func(o *options) {
+		o.caseInsensitive = true
+	}
 }
 
 type operation struct {
@@ -73,82 +625,508 @@ func (r *Result) Value() interface{} {
 	return r.value
 }
 
+// IsNull reports whether the path resolved to an explicit json null. A missing
+// path is reported as an error by Get instead.
+func (r *Result) IsNull() bool {
+	return r.value == nil
+}
+
 // First Provides the first item of an array
 func (r *Result) First() interface{} {
-	if r.isArray && reflect.TypeOf(r.value).Kind() == reflect.Slice {
+	return r.Index(0)
+}
+
+// Last provides the last item of an array
+func (r *Result) Last() interface{} {
+	return r.Index(-1)
+}
+
+// Index provides the item at idx of an array, counting from the end if idx is
+// negative, or nil if idx is out of range. A single value is its own first and
+// last item.
+func (r *Result) Index(idx int) interface{} {
+	if r.isArray && r.value != nil && reflect.TypeOf(r.value).Kind() == reflect.Slice {
 		v := reflect.ValueOf(r.value)
-		if reflect.ValueOf(r.value).Len() > 0 {
-			return v.Index(0).Interface()
-		} else {
+		if idx < 0 {
+			idx += v.Len()
+		}
+		if idx < 0 || idx >= v.Len() {
 			return nil
 		}
+		return v.Index(idx).Interface()
+	}
+	if idx == 0 || idx == -1 {
+		return r.value
 	}
+	return nil
+}
 
-	return r.value
+// ForEach calls fn for every item of an array result, or once with index 0 for
+// a single value. It does nothing for a nil result.
+func (r *Result) ForEach(fn func(index int, value interface{})) {
+	if r == nil || r.value == nil {
+		return
+	}
+	if r.isArray && reflect.TypeOf(r.value).Kind() == reflect.Slice {
+		v := reflect.ValueOf(r.value)
+		for i := 0; i < v.Len(); i++ {
+			fn(i, v.Index(i).Interface())
+		}
+		return
+	}
+	fn(0, r.value)
+}
+
+// scalar returns the value of r, or an error for arrays and nil results.
+func (r *Result) scalar() (interface{}, error) {
+	if r == nil {
+		return nil, IsNull
+	}
+	if r.isArray {
+		return nil, fmt.Errorf("result is an array: %v", r.value)
+	}
+	return r.value, nil
 }
 
-func MustCompile(jpath string) *Compiled {
-	c, err := Compile(jpath)
+// Float64 returns the value of r as a float64. It fails if the value is not a
+// number.
+func (r *Result) Float64() (float64, error) {
+	value, err := r.scalar()
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	return c
+	if _, ok := value.(string); ok || !isNumber(value) {
+		return 0, fmt.Errorf("result is not a number: %v", value)
+	}
+	return toFloat64(value)
 }
 
-func Compile(path string) (*Compiled, error) {
-	fragments, err := parse(path)
+// Int64 returns the value of r as an int64. It fails if the value is not an
+// integral number, like 10 or 10.0, or doesn't fit in an int64.
+func (r *Result) Int64() (int64, error) {
+	value, err := r.scalar()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	if fragments[0] != "@" && fragments[0] != "$" {
-		return nil, fmt.Errorf("path should start with '$' or '@'")
+	if _, ok := value.(string); ok || !isNumber(value) {
+		return 0, fmt.Errorf("result is not a number: %v", value)
 	}
-	fragments = fragments[1:]
-	res := Compiled{
-		path:       path,
-		operations: make([]operation, len(fragments)),
-		step:       0,
+	n, err := toBigFloat(value)
+	if err != nil {
+		return 0, err
 	}
-	for i, fragment := range fragments {
-		op, key, args, err := parseFragment(fragment)
-		if err != nil {
-			return nil, err
-		}
-		res.operations[i] = operation{op, key, args}
+	i, accuracy := n.Int64()
+	if accuracy != big.Exact {
+		return 0, fmt.Errorf("result is not an int64: %v", value)
 	}
-	return &res, nil
+	return i, nil
 }
 
-func (c *Compiled) next() *Compiled {
-	if c.step == len(c.operations)-1 {
-		return nil
+// String returns the value of r if it is a string.
+func (r *Result) String() (string, error) {
+	value, err := r.scalar()
+	if err != nil {
+		return "", err
 	}
-	c.step++
-	return c
+	str, ok := bytesAsString(value).(string)
+	if !ok {
+		return "", fmt.Errorf("result is not a string: %v", value)
+	}
+	return str, nil
 }
 
-func (c *Compiled) String() string {
-	return fmt.Sprintf("Compiled lookup: %s", c.path)
+// Bool returns the value of r if it is a bool.
+func (r *Result) Bool() (bool, error) {
+	value, err := r.scalar()
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("result is not a bool: %v", value)
+	}
+	return b, nil
+}
+
+// Get runs subPath against the value of r, so that queries can be chained, e.g.
+// `res.Get("$.book[0].title")`. subPath may start with `$` or `@`, both refer to
+// the value of r. An array result is queried as an array: `[0]` picks one of its
+// items, while a key like `$.title` is applied to every item.
+func (r *Result) Get(subPath string) (*Result, error) {
+	if r == nil {
+		return nil, IsNull
+	}
+	return Get(r.value, subPath)
+}
+
+func MustCompile(jpath string, opts ...Option) *Compiled {
+	c, err := Compile(jpath, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// Compile parses path into a reusable lookup.
+//
+// A bare numeric key like the `0` of `$.0.name` is a map key, so it only matches
+// objects with a "0" member; use `$[0].name` to index into an array, or compile
+// with NumericKeysAsIndex to resolve numeric keys against arrays at lookup time.
+func Compile(path string, opts ...Option) (*Compiled, error) {
+	o := newOptions(opts)
+	switch o.delimiter {
+	case '$', '@', '[', ']', '*', '?', '(', ')', '\'', ' ':
+		return nil, fmt.Errorf("invalid delimiter: %q", o.delimiter)
+	}
+	if o.delimiter >= utf8.RuneSelf {
+		return nil, fmt.Errorf("delimiter should be an ascii char: %q", o.delimiter)
+	}
+	fragments, err := parseWith(path, o.delimiter)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPath, err)
+	}
+	if fragments[0] != "@" && fragments[0] != "$" {
+		return nil, fmt.Errorf("%w: path should start with '$' or '@'", ErrInvalidPath)
+	}
+	fragments = fragments[1:]
+	res := Compiled{
+		path:       path,
+		operations: make([]operation, 0, len(fragments)),
+		step:       0,
+		opts:       o,
+	}
+	for _, fragment := range fragments {
+		if key, quoted, ok := quotedKey(fragment); ok {
+			if key != "" {
+				res.operations = append(res.operations, operation{"key", key, nil})
+			}
+			res.operations = append(res.operations, operation{"key", quoted, nil})
+			continue
+		}
+		op, key, args, err := parseFragment(fragment)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPath, err)
+		}
+		if op == "scan" && o.disallowScan {
+			return nil, fmt.Errorf("%w: recursive descent is not allowed: %s", ErrInvalidPath, path)
+		}
+		res.operations = append(res.operations, operation{op, key, args})
+	}
+	return &res, nil
+}
+
+// quotedKey splits a fragment like `['a.b']` or `store['a.b']` into its plain
+// key, which may be empty, and its unescaped quoted key.
+func quotedKey(fragment string) (key string, quoted string, ok bool) {
+	i := strings.Index(fragment, "[")
+	if i < 0 || !strings.HasPrefix(fragment[i:], "['") || !strings.HasSuffix(fragment, "']") || len(fragment) < i+4 {
+		return "", "", false
+	}
+	body := fragment[i+2 : len(fragment)-2]
+	var b strings.Builder
+	for j := 0; j < len(body); j++ {
+		if body[j] == '\\' && j+1 < len(body) {
+			j++
+		} else if body[j] == '\'' {
+			return "", "", false
+		}
+		b.WriteByte(body[j])
+	}
+	return fragment[:i], b.String(), true
+}
+
+// filterOps are the operators supported in filter expressions.
+var filterOps = map[string]bool{
+	"exists": true, "=~": true, "contains": true, "in": true, "between": true, "within": true,
+	"^=": true, "$=": true,
+	"<": true, "<=": true, "==": true, "!=": true, ">=": true, ">": true,
+}
+
+// ValidatePath reports whether path is a valid path without looking up any
+// data. Besides the syntax checks of Compile, it checks that brackets and
+// parentheses are balanced and that filters only use supported operators.
+// Errors wrap ErrInvalidPath.
+func ValidatePath(path string, opts ...Option) error {
+	c, err := Compile(path, opts...)
+	if err != nil {
+		return err
+	}
+	if err := checkBalanced(path); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPath, err)
+	}
+	for _, o := range c.operations {
+		if o.op != "filter" {
+			continue
+		}
+		filter, _ := o.args.(string)
+		expressions, err := parseFilter(filter)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPath, err)
+		}
+		for _, expr := range expressions {
+			if !filterOps[expr.op] {
+				return fmt.Errorf("%w: unsupported filter operator %q in: %s", ErrInvalidPath, expr.op, filter)
+			}
+		}
+	}
+	return nil
+}
+
+// checkBalanced checks that the brackets and parentheses of path outside of
+// quoted strings are balanced.
+func checkBalanced(path string) error {
+	stack := make([]rune, 0)
+	quoted := false
+	for i, x := range path {
+		switch {
+		case i > 0 && path[i-1] == '\\':
+		case x == '\'':
+			quoted = !quoted
+		case quoted:
+		case x == '[' || x == '(':
+			stack = append(stack, x)
+		case x == ']' || x == ')':
+			open := '['
+			if x == ')' {
+				open = '('
+			}
+			if len(stack) == 0 || stack[len(stack)-1] != open {
+				return fmt.Errorf("unbalanced %q at %d", x, i)
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if quoted {
+		return fmt.Errorf("unterminated quote")
+	}
+	if len(stack) > 0 {
+		return fmt.Errorf("unclosed %q", stack[len(stack)-1])
+	}
+	return nil
+}
+
+func (c *Compiled) next() *Compiled {
+	if c.step == len(c.operations)-1 {
+		return nil
+	}
+	c.step++
+	return c
+}
+
+// selectsElements reports whether the operation before step explicitly selects
+// elements of an array, like `[*]`, `[0,1]`, a slice, a filter or a scan, so
+// that the operation at step applies to each of them.
+func (c *Compiled) selectsElements(step int) bool {
+	if step == 0 {
+		return false
+	}
+	switch prev := c.operations[step-1]; prev.op {
+	case "range", "filter", "scan":
+		return true
+	case "idx":
+		return len(indexArgsOf(prev)) > 1
+	}
+	return false
+}
+
+func (c *Compiled) String() string {
+	return fmt.Sprintf("Compiled lookup: %s", c.path)
+}
+
+// PathString returns the path in canonical dot notation, so that passing it to
+// Compile yields the same operations. Unlike String it can be used as a cache
+// key or serialized. Paths compiled WithDelimiter are converted to `.` notation.
+func (c *Compiled) PathString() string {
+	path := "$"
+	for i, o := range c.operations {
+		switch {
+		case o.op == "scan" && i == len(c.operations)-1:
+			path += ".*"
+		case o.op == "scan":
+			path += "."
+		case o.key == "" && o.op != "key" && (i == 0 || c.operations[i-1].op != "scan"):
+			path += selectorExpr(o)
+		case o.key == "" && o.op != "key":
+			path += "." + selectorExpr(o)
+		case i > 0 && c.operations[i-1].op == "scan" && !strings.HasPrefix(keySegment(o.key), "."):
+			// `$..['a.b']`
+			path += "." + keySegment(o.key) + selectorExpr(o)
+		default:
+			path += keySegment(o.key) + selectorExpr(o)
+		}
+	}
+	return path
+}
+
+// PathBuilder builds a path programmatically, quoting keys that contain
+// characters with a meaning in paths, e.g.
+// `NewPath().Key("store").Key("book").Index(0).Key("title").Build()`.
+type PathBuilder struct {
+	path strings.Builder
+}
+
+// NewPath returns a PathBuilder starting at the root `$`.
+func NewPath() *PathBuilder {
+	b := &PathBuilder{}
+	b.path.WriteString("$")
+	return b
+}
+
+// Key appends a key, as `.key` or `['key']` if it needs quoting.
+func (b *PathBuilder) Key(key string) *PathBuilder {
+	b.path.WriteString(keySegment(key))
+	return b
+}
+
+// Index appends an array index, counting from the end if idx is negative.
+func (b *PathBuilder) Index(idx int) *PathBuilder {
+	fmt.Fprintf(&b.path, "[%d]", idx)
+	return b
+}
+
+// Range appends a slice from from to to, both inclusive.
+func (b *PathBuilder) Range(from, to int) *PathBuilder {
+	fmt.Fprintf(&b.path, "[%d:%d]", from, to)
+	return b
+}
+
+// Wildcard appends `[*]`, which selects every element.
+func (b *PathBuilder) Wildcard() *PathBuilder {
+	b.path.WriteString("[*]")
+	return b
+}
+
+// Filter appends a filter expression like `@.price < 10`, written as is.
+func (b *PathBuilder) Filter(expr string) *PathBuilder {
+	fmt.Fprintf(&b.path, "[?(%s)]", expr)
+	return b
+}
+
+// Build returns the path, or an error wrapping ErrInvalidPath if it doesn't
+// pass ValidatePath, e.g. because of a malformed filter.
+func (b *PathBuilder) Build() (string, error) {
+	path := b.path.String()
+	if err := ValidatePath(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+const (
+	costKey    = 1
+	costRange  = 5
+	costFilter = 10
+	costScan   = 50
+)
+
+// Cost returns a static estimate of how expensive the lookup is, without
+// looking at any data. Key and index access are cheap, while wildcards, filters
+// and recursive descent fan out over many nodes, so they and every operation
+// following them weigh more.
+func (c *Compiled) Cost() int {
+	cost, fanout := 0, 1
+	for _, o := range c.operations {
+		switch o.op {
+		case "key":
+			cost += costKey * fanout
+		case "idx":
+			if idxs, ok := o.args.([]int); ok {
+				cost += costKey * fanout * len(idxs)
+			} else {
+				cost += costKey * fanout
+			}
+		case "range":
+			cost += costRange * fanout
+			fanout *= costRange
+		case "filter":
+			cost += costFilter * fanout
+			fanout *= costRange
+		case "scan":
+			cost += costScan * fanout
+			fanout *= costScan
+		}
+	}
+	return cost
+}
+
+// Fields returns every literal key referenced by the path, including the keys
+// referenced by filter expressions, in order of appearance without duplicates.
+// Wildcards and indices are not included.
+func (c *Compiled) Fields() []string {
+	fields := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(key string) {
+		if key != "" && key != "*" && !seen[key] {
+			seen[key] = true
+			fields = append(fields, key)
+		}
+	}
+	for _, o := range c.operations {
+		add(o.key)
+		if o.op != "filter" {
+			continue
+		}
+		filter, _ := o.args.(string)
+		expressions, err := parseFilter(filter)
+		if err != nil {
+			continue
+		}
+		for _, expr := range expressions {
+			for _, p := range []string{expr.lp, expr.rp} {
+				if !isPathOperand(p) {
+					continue
+				}
+				steps, err := parse(p)
+				if err != nil {
+					continue
+				}
+				for _, step := range steps[1:] {
+					if _, key, _, err := parseFragment(step); err == nil {
+						add(key)
+					}
+				}
+			}
+		}
+	}
+	return fields
+}
+
+// UnboundedDepth is returned by Depth for paths using recursive descent.
+const UnboundedDepth = -1
+
+// Depth returns the number of operations of the path, or UnboundedDepth if it
+// uses recursive descent and can therefore reach any depth.
+func (c *Compiled) Depth() int {
+	for _, o := range c.operations {
+		if o.op == "scan" {
+			return UnboundedDepth
+		}
+	}
+	return len(c.operations)
 }
 
 func (c *Compiled) _decompile(obj interface{}) (path string, err error) {
+	root := obj
 	path = ""
 	for _, s := range c.operations {
 		switch s.op {
 		case "key":
-			obj, err = _getByKey(obj, s.key)
+			obj, err = c._getByKey(obj, s.key)
 			if err != nil {
 				return "", err
 			}
 			path += fmt.Sprintf(".%s", s.key)
 		case "idx":
 			if len(s.key) > 0 {
-				obj, err = _getByKey(obj, s.key)
+				obj, err = c._getByKey(obj, s.key)
 				if err != nil {
 					return "", err
 				}
 			}
-			idxs := s.args.([]int)
+			idxs, err := indexArgs(obj, s)
+			if err != nil {
+				return "", err
+			}
 			ss := make([]string, 0, len(idxs))
 			if len(idxs) > 1 {
 				res := make([]interface{}, 0)
@@ -178,38 +1156,22 @@ func (c *Compiled) _decompile(obj interface{}) (path string, err error) {
 			}
 		case "range":
 			if len(s.key) > 0 {
-				obj, err = _getByKey(obj, s.key)
+				obj, err = c._getByKey(obj, s.key)
 				if err != nil {
 					return "", err
 				}
 			}
-			if args, ok := s.args.([2]interface{}); ok == true {
-				obj, err = getByRange(obj, args[0], args[1])
-				if err != nil {
-					return "", err
-				}
-				from := ""
-				to := ""
-				if args[0] != nil {
-					from = fmt.Sprintf("%v", args[0])
-				}
-				if args[1] != nil {
-					to = fmt.Sprintf("%v", args[1])
-				}
-				if from == "" && to == "" {
-					path += fmt.Sprintf(".%s[*]", s.key)
-				} else {
-					path += fmt.Sprintf(".%s[%s:%s]", s.key, from, to)
-				}
-			} else {
-				return "", fmt.Errorf("range args length should be 2")
+			obj, err = getByRangeArgs(obj, s.args)
+			if err != nil {
+				return "", err
 			}
+			path += fmt.Sprintf(".%s[%s]", s.key, rangeExpr(s.args))
 		case "filter":
-			obj, err = _getByKey(obj, s.key)
+			obj, err = c._getByKey(obj, s.key)
 			if err != nil {
 				return "", err
 			}
-			obj, err = getFiltered(obj, obj, s.args.(string))
+			obj, err = getFiltered(obj, root, s.args.(string))
 			if err != nil {
 				return "", err
 			}
@@ -223,6 +1185,13 @@ func (c *Compiled) _decompile(obj interface{}) (path string, err error) {
 }
 
 func (c *Compiled) decompile(obj interface{}) (path string, isArray bool, err error) {
+	// decompileFrom advances the step of its receiver, like lookup
+	d := *c
+	d.step = 0
+	return d.decompileFrom(obj, obj)
+}
+
+func (c *Compiled) decompileFrom(obj, root interface{}) (path string, isArray bool, err error) {
 	if reflect.TypeOf(obj) == nil {
 		err = IsNull
 		return
@@ -231,7 +1200,7 @@ func (c *Compiled) decompile(obj interface{}) (path string, isArray bool, err er
 	case reflect.Slice:
 		for i := 0; i < reflect.ValueOf(obj).Len(); i++ {
 			item := reflect.ValueOf(obj).Index(i).Interface()
-			path, isArray, err = c.decompile(item)
+			path, isArray, err = c.decompileFrom(item, root)
 			if err != nil {
 				continue
 			}
@@ -242,7 +1211,7 @@ func (c *Compiled) decompile(obj interface{}) (path string, isArray bool, err er
 		operation := c.operations[c.step]
 		switch operation.op {
 		case "key":
-			obj, err = getByKey(obj, operation.key)
+			obj, err = c.getByKey(obj, operation.key)
 			if err != nil {
 				return
 			}
@@ -250,13 +1219,17 @@ func (c *Compiled) decompile(obj interface{}) (path string, isArray bool, err er
 		case "idx":
 			if len(operation.key) > 0 {
 				// no key `$[0].test`
-				obj, err = getByKey(obj, operation.key)
+				obj, err = c.getByKey(obj, operation.key)
 				if err != nil {
 					return
 				}
 			}
 
-			idxs := operation.args.([]int)
+			var idxs []int
+			idxs, err = indexArgs(obj, operation)
+			if err != nil {
+				return
+			}
 			ss := make([]string, 0, len(idxs))
 			if len(idxs) > 1 {
 				arr := make([]interface{}, 0, len(idxs))
@@ -289,40 +1262,25 @@ func (c *Compiled) decompile(obj interface{}) (path string, isArray bool, err er
 			}
 		case "range":
 			if len(operation.key) > 0 {
-				obj, err = getByKey(obj, operation.key)
+				obj, err = c.getByKey(obj, operation.key)
 				if err != nil {
 					return
 				}
 			}
-			if args, ok := operation.args.([2]interface{}); ok == true {
-				obj, err = getByRange(obj, args[0], args[1])
-				if err != nil {
-					return
-				}
-				isArray = true
-				from := ""
-				to := ""
-				if args[0] != nil {
-					from = fmt.Sprintf("%v", args[0])
-				}
-				if args[1] != nil {
-					to = fmt.Sprintf("%v", args[1])
-				}
-				if from == "" && to == "" {
-					path = fmt.Sprintf(".%s[*]", operation.key)
-				} else {
-					path = fmt.Sprintf(".%s[%s:%s]", operation.key, from, to)
-				}
-			} else {
-				err = fmt.Errorf("range args length should be 2")
+			obj, err = getByRangeArgs(obj, operation.args)
+			if err != nil {
 				return
 			}
+			isArray = true
+			path = fmt.Sprintf(".%s[%s]", operation.key, rangeExpr(operation.args))
 		case "filter":
-			obj, err = getByKey(obj, operation.key)
-			if err != nil {
-				return
+			if len(operation.key) > 0 {
+				obj, err = c.getByKey(obj, operation.key)
+				if err != nil {
+					return
+				}
 			}
-			obj, err = getFiltered(obj, obj, operation.args.(string))
+			obj, err = getFiltered(obj, root, operation.args.(string))
 			if err != nil {
 				return
 			}
@@ -342,25 +1300,144 @@ func (c *Compiled) decompile(obj interface{}) (path string, isArray bool, err er
 		return
 	}
 
-	suffix, isArray, err := next.decompile(obj)
+	suffix, isArray, err := next.decompileFrom(obj, root)
 	return path + suffix, isArray, err
 }
 
+// Lookup resolves the path against obj. Matched values are not copied: maps,
+// slices and pointers are the very ones stored in obj, so that mutating the
+// book map returned by `$.store.book[0]`, or one of the elements returned by
+// `$.store.book[*]`, changes obj too and can be followed by Set on obj. Values
+// of other types, like structs or the elements of a typed slice such as
+// []Book, are copies. The array of several matches is a new []interface{},
+// except for a slice like `[*]` or `[1:3]`, which is a slice of the very array
+// stored in obj: replacing one of its elements replaces it in obj too. Use
+// GetCopy for results independent of obj.
+//
+// A path with recursive descent, like `$.store..price`, or a trailing `.*`
+// always returns an array, with the matches in the order of LookupAllPaths. A
+// trailing `.*` matches every descendant, the same as `..*`.
+//
+// A key applied to an array, like `$.store.book.author`, applies to each of its
+// elements and flattens exactly one level: an element that is an array itself
+// yields the nested array of its own values of the key, so `.x` of
+// `[[{"x": 1}], [{"x": 2}]]` is `[[1] [2]]`. A value of the key that is an array
+// itself is not flattened either.
+//
+// An element for which a filter expression fails to evaluate, like a
+// comparison between an array and a number, doesn't match. Use LookupStrict to
+// get the error instead.
 func (c *Compiled) Lookup(obj interface{}) (res interface{}, isArray bool, err error) {
+	if obj, err = decodeRoot(obj); err != nil {
+		return
+	}
+	if c.scans() {
+		return c.lookupScan(obj)
+	}
+	// lookup advances the step of its receiver, so it runs on a copy, which
+	// lets the same Compiled be looked up repeatedly and concurrently
+	lookup := *c
+	lookup.step = 0
+	visited := 0
+	return lookup.lookup(obj, obj, &visited)
+}
+
+// scans reports whether the path uses recursive descent.
+func (c *Compiled) scans() bool {
+	for _, o := range c.operations {
+		if o.op == "scan" {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupScan looks up a path with recursive descent, which is only matched by
+// walk.
+func (c *Compiled) lookupScan(obj interface{}) (interface{}, bool, error) {
+	res := make([]interface{}, 0)
+	err := c.walkValues(obj, func(path string, depth int, value interface{}) error {
+		res = append(res, value)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return res, true, nil
+}
+
+// lookup applies the remaining operations to obj; root is the document that
+// `$` refers to in filters.
+func (c *Compiled) lookup(obj, root interface{}, visited *int) (res interface{}, isArray bool, err error) {
+	if err = c.visit(visited); err != nil {
+		return
+	}
+	if len(c.operations) == 0 {
+		// `$` is the root itself, whatever its type
+		return obj, false, nil
+	}
 	if obj == nil {
+		// a present null is only a valid result at the end of the path
+		err = ErrGetFromNullObj
 		return
 	}
-	switch reflect.TypeOf(obj).Kind() {
-	case reflect.Slice:
-		arr := make([]interface{}, 0)
+	if obj, err = decodeRaw(obj); err != nil {
+		return
+	}
+	if obj == nil {
+		// a json.RawMessage holding `null`
+		err = ErrGetFromNullObj
+		return
+	}
+	kind := reflect.TypeOf(obj).Kind()
+	if _, ok := obj.(Getter); ok {
+		// Getters are looked up like maps, whatever their underlying type
+		kind = reflect.Map
+	}
+	operation := c.operations[c.step]
+	// `$[0]`, `$[1:]` and `$[?()]` apply to an array itself rather than to its elements
+	direct := kind == reflect.Slice && operation.key == "" && (operation.op == "idx" || operation.op == "range" || operation.op == "filter")
+	switch {
+	case kind == reflect.Slice && !direct:
+		if idx, ok := c.numericKey(c.operations[c.step]); ok {
+			obj, err = getByIdx(obj, idx)
+			if err != nil {
+				return
+			}
+			break
+		}
+		if c.opts.noImplicitArray && !c.selectsElements(c.step) {
+			err = implicitArrayError(operation.key)
+			return
+		}
+		// a key applies to every element; elements that don't match are skipped
+		arr := make([]interface{}, 0, reflect.ValueOf(obj).Len())
+		start := c.step
 		for i := 0; i < reflect.ValueOf(obj).Len(); i++ {
 			item := reflect.ValueOf(obj).Index(i).Interface()
+			if item == nil {
+				// a null element is kept as null rather than failing on the
+				// keys that follow it
+				arr = append(arr, nil)
+				continue
+			}
 			var value interface{}
-			value, isArray, err = c.Lookup(item)
+			c.step = start
+			value, isArray, err = c.lookup(item, root, visited)
 			if err != nil {
+				if c.opts.strict || errors.Is(err, ErrTooManyNodes) || errors.Is(err, errImplicitArray) {
+					return nil, false, err
+				}
+				if c.opts.errs != nil {
+					*c.opts.errs = append(*c.opts.errs, fmt.Errorf("[%d]: %w", i, err))
+				}
+				err = nil
 				continue
 			}
-			if isArray && reflect.TypeOf(value).Kind() == reflect.Slice {
+			// the matches below an element are flattened into the result, but
+			// an element that is an array itself keeps its matches nested, so
+			// that the key flattens exactly one level
+			if isArray && reflect.TypeOf(value).Kind() == reflect.Slice && !isArrayValue(item) {
 				v := reflect.ValueOf(value)
 				for j := 0; j < v.Len(); j++ {
 					arr = append(arr, v.Index(j).Interface())
@@ -372,23 +1449,26 @@ func (c *Compiled) Lookup(obj interface{}) (res interface{}, isArray bool, err e
 		res = arr
 		isArray = true
 		return
-	case reflect.Map:
-		operation := c.operations[c.step]
+	case kind == reflect.Map || direct:
 		switch operation.op {
 		case "key":
-			obj, err = getByKey(obj, operation.key)
+			obj, err = c.getByKey(obj, operation.key)
 			if err != nil {
 				return
 			}
 		case "idx":
 			if len(operation.key) > 0 {
-				obj, err = getByKey(obj, operation.key)
+				obj, err = c.getByKey(obj, operation.key)
 				if err != nil {
 					return
 				}
 			}
 
-			idxs := operation.args.([]int)
+			var idxs []int
+			idxs, err = indexArgs(obj, operation)
+			if err != nil {
+				return
+			}
 			if len(idxs) > 1 {
 				arr := make([]interface{}, 0, len(idxs))
 				for _, idx := range idxs {
@@ -412,27 +1492,24 @@ func (c *Compiled) Lookup(obj interface{}) (res interface{}, isArray bool, err e
 			}
 		case "range":
 			if len(operation.key) > 0 {
-				obj, err = getByKey(obj, operation.key)
+				obj, err = c.getByKey(obj, operation.key)
 				if err != nil {
 					return
 				}
 			}
-			if args, ok := operation.args.([2]interface{}); ok == true {
-				obj, err = getByRange(obj, args[0], args[1])
-				if err != nil {
-					return
-				}
-				isArray = true
-			} else {
-				err = fmt.Errorf("range args length should be 2")
+			obj, err = getByRangeArgs(obj, operation.args)
+			if err != nil {
 				return
 			}
+			isArray = true
 		case "filter":
-			obj, err = getByKey(obj, operation.key)
-			if err != nil {
-				return
+			if len(operation.key) > 0 {
+				obj, err = c.getByKey(obj, operation.key)
+				if err != nil {
+					return
+				}
 			}
-			obj, err = getFiltered(obj, obj, operation.args.(string))
+			obj, err = getFilteredWith(obj, root, operation.args.(string), c.opts)
 			if err != nil {
 				return
 			}
@@ -451,30 +1528,39 @@ func (c *Compiled) Lookup(obj interface{}) (res interface{}, isArray bool, err e
 		res = obj
 		return
 	}
-	return next.Lookup(obj)
+	return next.lookup(obj, root, visited)
 }
 
 func (c *Compiled) _Lookup(obj interface{}) (interface{}, error) {
 	var err error
+	root := obj
+	spread := false
 	for _, s := range c.operations {
+		if s.op != "key" {
+			spread = false
+		}
 		switch s.op {
 		case "key":
-			obj, err = _getByKey(obj, s.key)
+			obj, spread, err = c.getByKeyFrom(obj, s.key, spread)
 			if err != nil {
 				return nil, err
 			}
 		case "idx":
 			if len(s.key) > 0 {
 				// no key `$[0].test`
-				obj, err = _getByKey(obj, s.key)
+				obj, err = c._getByKey(obj, s.key)
 				if err != nil {
 					return nil, err
 				}
 			}
 
-			if len(s.args.([]int)) > 1 {
+			idxs, err := indexArgs(obj, s)
+			if err != nil {
+				return nil, err
+			}
+			if len(idxs) > 1 {
 				res := make([]interface{}, 0)
-				for _, x := range s.args.([]int) {
+				for _, x := range idxs {
 					tmp, err := getByIdx(obj, x)
 					if err != nil {
 						return nil, err
@@ -482,8 +1568,8 @@ func (c *Compiled) _Lookup(obj interface{}) (interface{}, error) {
 					res = append(res, tmp)
 				}
 				obj = res
-			} else if len(s.args.([]int)) == 1 {
-				obj, err = getByIdx(obj, s.args.([]int)[0])
+			} else if len(idxs) == 1 {
+				obj, err = getByIdx(obj, idxs[0])
 				if err != nil {
 					return nil, err
 				}
@@ -493,25 +1579,21 @@ func (c *Compiled) _Lookup(obj interface{}) (interface{}, error) {
 		case "range":
 			if len(s.key) > 0 {
 				// no key `$[:1].test`
-				obj, err = _getByKey(obj, s.key)
+				obj, err = c._getByKey(obj, s.key)
 				if err != nil {
 					return nil, err
 				}
 			}
-			if args, ok := s.args.([2]interface{}); ok == true {
-				obj, err = getByRange(obj, args[0], args[1])
-				if err != nil {
-					return nil, err
-				}
-			} else {
-				return nil, fmt.Errorf("range args length should be 2")
+			obj, err = getByRangeArgs(obj, s.args)
+			if err != nil {
+				return nil, err
 			}
 		case "filter":
-			obj, err = _getByKey(obj, s.key)
+			obj, err = c._getByKey(obj, s.key)
 			if err != nil {
 				return nil, err
 			}
-			obj, err = getFiltered(obj, obj, s.args.(string))
+			obj, err = getFiltered(obj, root, s.args.(string))
 			if err != nil {
 				return nil, err
 			}
@@ -522,91 +1604,1519 @@ func (c *Compiled) _Lookup(obj interface{}) (interface{}, error) {
 	return obj, nil
 }
 
-func (c *Compiled) Set(obj interface{}, val interface{}) error {
-	if len(c.operations) < 1 {
-		return fmt.Errorf("need at least one levels to set value")
-	}
-	sub := Compiled{operations: c.operations[0 : len(c.operations)-1]}
-
-	parent, err := sub._Lookup(obj)
+// LookupMap returns every value matched by the path keyed by its concrete path,
+// e.g. `$..price` => {"$.store.book[0].price": 8.95, ...}.
+func (c *Compiled) LookupMap(obj interface{}) (map[string]interface{}, error) {
+	matches, err := c.LookupAllPaths(obj)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	res := make(map[string]interface{}, len(matches))
+	for _, m := range matches {
+		res[m.Path] = m.Value
+	}
+	return res, nil
+}
+
+// Match is a value matched by LookupAllPaths.
+type Match struct {
+	// Path is the concrete path of the value, e.g. `$.store.book[0].price`
+	Path  string
+	Value interface{}
+}
+
+// LookupAllPaths returns every value matched by the path together with its
+// concrete path, in document order. Paths are built while descending, so it
+// takes a single pass over obj however many values match. The values are those
+// of Lookup, including nulls, except that the matches Lookup nests for an
+// element that is an array itself are listed one by one. A failure of the
+// path itself, like an implicit descent with DisallowImplicitDescent, fails it
+// like Lookup.
+func (c *Compiled) LookupAllPaths(obj interface{}) ([]Match, error) {
+	res := make([]Match, 0)
+	err := c.walkValues(obj, func(path string, depth int, value interface{}) error {
+		res = append(res, Match{Path: path, Value: value})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// PathSet is a set of paths compiled once, to test which nodes of documents
+// they match, e.g. for editability or access checks.
+type PathSet struct {
+	compiled []*Compiled
+}
+
+// NewPathSet compiles paths into a PathSet.
+func NewPathSet(paths ...string) (*PathSet, error) {
+	set := &PathSet{compiled: make([]*Compiled, 0, len(paths))}
+	for _, path := range paths {
+		c, err := Compile(path)
+		if err != nil {
+			return nil, err
+		}
+		set.compiled = append(set.compiled, c)
+	}
+	return set, nil
+}
+
+// Contains reports whether the node at the concrete candidatePath, like
+// `$.store.book[0].price` or `$.store.book[-1].price`, is matched by any path
+// of the set in obj. Only the nodes on the way to the candidate are visited.
+func (s *PathSet) Contains(obj interface{}, candidatePath string) bool {
+	candidate, err := Compile(candidatePath)
+	if err != nil {
+		return false
+	}
+	// the concrete path of the candidate node, with negative indices resolved
+	target, err := candidate.Reverse(obj)
+	if err != nil {
+		return false
+	}
+	for _, c := range s.compiled {
+		found := false
+		c.walkWithin(obj, target, func(path string, depth int, value interface{}) error {
+			if path == target {
+				found = true
+				return errStopWalk
+			}
+			return nil
+		})
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns the sorted concrete paths of every node of obj matched by any
+// path of the set, without duplicates.
+func (s *PathSet) Matches(obj interface{}) []string {
+	seen := make(map[string]bool)
+	for _, c := range s.compiled {
+		c.walk(obj, func(path string, depth int, value interface{}) error {
+			seen[path] = true
+			return nil
+		})
+	}
+	paths := make([]string, 0, len(seen))
+	for path := range seen {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Reverse returns the concrete path of the single node matched by the path in
+// obj, e.g. `$.store.book[2]` for `$.store.book[?(@.isbn == '0-553-21311-3')]`,
+// so that the node can be written back with Set. It fails if the path matches
+// no node or more than one.
+func (c *Compiled) Reverse(obj interface{}) (string, error) {
+	paths := make([]string, 0, 1)
+	err := c.walk(obj, func(path string, depth int, value interface{}) error {
+		paths = append(paths, path)
+		if len(paths) > 1 {
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	switch len(paths) {
+	case 0:
+		return "", fmt.Errorf("%w: %s", ErrNotFound, c.path)
+	case 1:
+		return paths[0], nil
+	default:
+		return "", fmt.Errorf("path matches more than one node: %s", c.path)
+	}
+}
+
+// LookupStrict works like Lookup, but fails on any resolution failure instead
+// of skipping it:
+//   - a key missing from an object, including from any element of an array a
+//     key is applied to, like `$.store.book.isbn`
+//   - an index or range out of bounds, or a null in the middle of the path
+//   - a filter expression failing to evaluate, like a comparison between an
+//     array and a number or an invalid regexp
+//
+// A filter expression whose operand is missing from an element, like `@.isbn`
+// for a book without isbn, is not a failure: the element doesn't match, and a
+// filter matching no element yields an empty array.
+func (c *Compiled) LookupStrict(obj interface{}) (interface{}, error) {
+	strict := *c
+	strict.opts.strict = true
+	res, _, err := strict.Lookup(obj)
+	return res, err
+}
+
+// LookupWithErrorsCollected works like Lookup, but also reports why elements
+// were skipped: results holds every matched value, flattened like the result of
+// Lookup, and errs an error for each array element the rest of the path failed
+// on, like a missing key, prefixed with the index of the element. If the path
+// fails as a whole, results is empty and errs holds that error alone.
+func (c *Compiled) LookupWithErrorsCollected(obj interface{}) (results []interface{}, errs []error) {
+	collect := *c
+	collect.opts.errs = &errs
+	res, isArray, err := collect.Lookup(obj)
+	if err != nil {
+		return nil, append(errs[:0], err)
+	}
+	if values, ok := res.([]interface{}); isArray && ok {
+		return values, errs
+	}
+	return []interface{}{res}, errs
+}
+
+// LookupDistinct returns the values matched by the path without duplicates, in
+// the order they first occur, e.g. the categories of `$.store.book[*].category`.
+// Scalars are equal if NormalizeNumbers makes them equal, so that 1 and 1.0 are
+// the same number while 1 and "1" differ. Objects and arrays are never
+// considered duplicates.
+func (c *Compiled) LookupDistinct(obj interface{}) ([]interface{}, error) {
+	res, isArray, err := c.Lookup(obj)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := res.([]interface{})
+	if !isArray || !ok {
+		return []interface{}{res}, nil
+	}
+	seen := make(map[interface{}]bool, len(values))
+	distinct := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		key := NormalizeNumbers(v)
+		if key != nil && (isContainer(key) || !reflect.TypeOf(key).Comparable()) {
+			distinct = append(distinct, v)
+			continue
+		}
+		if !seen[key] {
+			seen[key] = true
+			distinct = append(distinct, v)
+		}
+	}
+	return distinct, nil
+}
+
+// LookupBytes decodes a json document, with numbers as json.Number like
+// GetFromReader does, and resolves the path against it. It doesn't change c,
+// so one compiled path can be applied to many payloads concurrently.
+func (c *Compiled) LookupBytes(data []byte) (*Result, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var obj interface{}
+	if err := decoder.Decode(&obj); err != nil {
+		return nil, err
+	}
+	value, isArray, err := c.Lookup(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{
+		value:   value,
+		isArray: isArray,
+	}, nil
+}
+
+// LookupInto resolves the path and decodes the matched value into target, which
+// should be a pointer, by marshaling it to json and unmarshaling it back.
+func (c *Compiled) LookupInto(obj interface{}, target interface{}) error {
+	value, _, err := c.Lookup(obj)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, target)
+}
+
+// LookupFirst returns the first value matched by the path in document order,
+// stopping as soon as it is found. found is false if nothing matched. See
+// LookupAllPaths for how the matches relate to Lookup.
+func (c *Compiled) LookupFirst(obj interface{}) (value interface{}, found bool, err error) {
+	err = c.walkValues(obj, func(path string, depth int, v interface{}) error {
+		value, found = v, true
+		return errStopWalk
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return value, found, nil
+}
+
+// LookupN returns at most n values matched by the path in document order,
+// stopping as soon as n are found. If n <= 0 every match is returned. See
+// LookupAllPaths for how the matches relate to Lookup.
+func (c *Compiled) LookupN(obj interface{}, n int) ([]interface{}, error) {
+	res := make([]interface{}, 0)
+	err := c.walkValues(obj, func(path string, depth int, value interface{}) error {
+		res = append(res, value)
+		if n > 0 && len(res) >= n {
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// TraceStep records how one operation of a path narrowed down the matched nodes.
+type TraceStep struct {
+	// Op is one of "key", "idx", "range", "filter" or "scan"
+	Op string
+	// Key is the key of the operation, e.g. `book` of `book[?(@.price > 10)]`
+	Key string
+	// Selector is the bracket part of the operation, e.g. `[?(@.price > 10)]`
+	Selector string
+	// Matched is false if no node was left after the operation
+	Matched bool
+	// Nodes is the number of nodes left after the operation
+	Nodes int
+}
+
+// LookupTrace works like Lookup, but also returns a trace of every step of the
+// path with the number of nodes it matched, which helps finding out why a path
+// matches nothing. The trace stops at the first step that matched no node.
+// Recursive descent is traced together with the operation that follows it.
+func (c *Compiled) LookupTrace(obj interface{}) (result interface{}, trace []TraceStep, err error) {
+	nodes := []interface{}{obj}
+	isArray := false
+	st := &walkState{seen: ancestors{}}
+	for step := 0; step < len(c.operations); step++ {
+		operation := c.operations[step]
+		sub := Compiled{operations: c.operations[step : step+1], opts: c.opts}
+		if operation.op == "scan" && step+1 < len(c.operations) {
+			step++
+			sub.operations = c.operations[step-1 : step+1]
+			operation.key = c.operations[step].key
+		}
+		if operation.op != "key" && operation.op != "idx" || len(indexArgsOf(operation)) > 1 {
+			isArray = true
+		}
+
+		matched := make([]interface{}, 0)
+		for _, node := range nodes {
+			err = sub.walkStep(node, obj, 0, "$", 0, st, func(path string, depth int, value interface{}) error {
+				matched = append(matched, value)
+				return nil
+			})
+			if err != nil {
+				return nil, trace, err
+			}
+		}
+		nodes = matched
+		trace = append(trace, TraceStep{
+			Op:       operation.op,
+			Key:      operation.key,
+			Selector: selectorExpr(sub.operations[len(sub.operations)-1]),
+			Matched:  len(nodes) > 0,
+			Nodes:    len(nodes),
+		})
+		if len(nodes) == 0 {
+			return nil, trace, fmt.Errorf("%w: %s", ErrNotFound, c.path)
+		}
+	}
+	if isArray {
+		return nodes, trace, nil
+	}
+	return nodes[0], trace, nil
+}
+
+// indexArgsOf returns the static indices of an "idx" operation.
+func indexArgsOf(operation operation) []int {
+	idxs, _ := operation.args.([]int)
+	return idxs
+}
+
+// selectorExpr formats the bracket part of an operation back into its path form.
+func selectorExpr(operation operation) string {
+	switch operation.op {
+	case "idx":
+		if script, ok := operation.args.(scriptIndex); ok {
+			parts := []string{script.operands[0]}
+			for i, op := range script.operators {
+				parts = append(parts, string(op), script.operands[i+1])
+			}
+			return "[(" + strings.Join(parts, "") + ")]"
+		}
+		idxs := indexArgsOf(operation)
+		parts := make([]string, len(idxs))
+		for i, idx := range idxs {
+			parts[i] = strconv.Itoa(idx)
+		}
+		return "[" + strings.Join(parts, ",") + "]"
+	case "range":
+		return "[" + rangeExpr(operation.args) + "]"
+	case "filter":
+		return fmt.Sprintf("[?(%v)]", operation.args)
+	}
+	return ""
+}
+
+var errStopWalk = errors.New("stop walk")
+
+// visitor is called by walk for every matched node. Returning errStopWalk stops
+// the walk without error, any other error aborts it.
+type visitor func(path string, depth int, value interface{}) error
+
+// walkState is the state of a single walk.
+type walkState struct {
+	// visited counts the visited nodes, see MaxNodes
+	visited int
+	// within restricts the walk to the nodes on the way to this concrete path
+	within string
+	// seen stops recursive descent at cycles
+	seen ancestors
+	// keepNulls visits the null elements of an array a key is applied to,
+	// which Lookup returns as null
+	keepNulls bool
+}
+
+// walk matches the path against obj and calls visit with the concrete path of
+// every matched node, in document order. Map members are visited in sorted key
+// order; depth is the number of steps from the root to the node.
+func (c *Compiled) walk(obj interface{}, visit visitor) error {
+	return c.walkWithin(obj, "", visit)
+}
+
+// walkWithin works like walk, but only descends into the nodes on the way to
+// the concrete path within, if set, so that only that node can be visited.
+func (c *Compiled) walkWithin(obj interface{}, within string, visit visitor) error {
+	return c.walkFrom(obj, &walkState{within: within, seen: ancestors{}}, visit)
+}
+
+// walkValues works like walk, but matches the same values as Lookup, including
+// the null elements of an array a key is applied to, so that the functions
+// built on it return what Lookup returns.
+func (c *Compiled) walkValues(obj interface{}, visit visitor) error {
+	return c.walkFrom(obj, &walkState{seen: ancestors{}, keepNulls: true}, visit)
+}
+
+func (c *Compiled) walkFrom(obj interface{}, st *walkState, visit visitor) error {
+	obj, err := decodeRoot(obj)
+	if err != nil {
+		return err
+	}
+	err = c.walkStep(obj, obj, 0, "$", 0, st, visit)
+	if err == errStopWalk {
+		return nil
+	}
+	return err
+}
+
+func (c *Compiled) walkStep(obj, root interface{}, step int, path string, depth int, st *walkState, visit visitor) error {
+	if st.within != "" && !strings.HasPrefix(st.within, path) {
+		return nil
+	}
+	if err := c.visit(&st.visited); err != nil {
+		return err
+	}
+	if step == len(c.operations) {
+		return visit(path, depth, obj)
+	}
+	obj, err := decodeRaw(obj)
+	if err != nil || reflect.TypeOf(obj) == nil {
+		return nil
+	}
+	operation := c.operations[step]
+	if operation.op == "scan" {
+		return c.walkScan(obj, root, step, path, depth, st, visit)
+	}
+
+	kind := reflect.TypeOf(obj).Kind()
+	if _, ok := obj.(Getter); ok {
+		kind = reflect.Map
+	}
+	if len(operation.key) > 0 {
+		switch kind {
+		case reflect.Map:
+			value, err := c.getByKey(obj, operation.key)
+			if err != nil {
+				return nil
+			}
+			obj, path, depth = value, path+"."+operation.key, depth+1
+		case reflect.Slice:
+			if idx, ok := c.numericKey(operation); ok {
+				length := reflect.ValueOf(obj).Len()
+				if idx < 0 {
+					idx += length
+				}
+				if idx < 0 || idx >= length {
+					return nil
+				}
+				return c.walkStep(reflect.ValueOf(obj).Index(idx).Interface(), root, step+1, fmt.Sprintf("%s[%d]", path, idx), depth+1, st, visit)
+			}
+			if c.opts.noImplicitArray && !c.selectsElements(step) {
+				return implicitArrayError(operation.key)
+			}
+			// descend into the elements of an array, like _getByKey does
+			for _, child := range children(obj) {
+				if child.value == nil && st.keepNulls {
+					// like Lookup, a null element is matched as null
+					if err := visit(path+child.path, depth+1, nil); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := c.walkStep(child.value, root, step, path+child.path, depth+1, st, visit); err != nil {
+					return err
+				}
+			}
+			return nil
+		default:
+			return nil
+		}
+		if operation.op == "key" {
+			return c.walkStep(obj, root, step+1, path, depth, st, visit)
+		}
+		if obj, err = decodeRaw(obj); err != nil || reflect.TypeOf(obj) == nil {
+			return nil
+		}
+		kind = reflect.TypeOf(obj).Kind()
+	}
+
+	switch operation.op {
+	case "idx", "range":
+		if isWildcard(operation) && kind != reflect.Slice {
+			for _, child := range structFields(obj) {
+				if err := c.walkStep(child.value, root, step+1, path+child.path, depth+1, st, visit); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if kind != reflect.Slice {
+			return nil
+		}
+		idxs, err := selectIndices(reflect.ValueOf(obj).Len(), operation)
+		if err != nil {
+			return nil
+		}
+		v := reflect.ValueOf(obj)
+		// Lookup applies a key following several elements to each of them,
+		// and returns null for the null ones
+		keepNulls := st.keepNulls && (operation.op == "range" || len(idxs) > 1) &&
+			step+1 < len(c.operations) && len(c.operations[step+1].key) > 0
+		for _, idx := range idxs {
+			elem, elemPath := v.Index(idx).Interface(), fmt.Sprintf("%s[%d]", path, idx)
+			if elem == nil && keepNulls {
+				if err := visit(elemPath, depth+1, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := c.walkStep(elem, root, step+1, elemPath, depth+1, st, visit); err != nil {
+				return err
+			}
+		}
+	case "filter":
+		expressions, err := parseFilterWith(operation.args.(string), c.opts)
+		if err != nil {
+			return err
+		}
+		if kind != reflect.Slice && kind != reflect.Map {
+			return nil
+		}
+		for _, child := range children(obj) {
+			matched := expressions
+			if kind == reflect.Map {
+				matched = bindKey(expressions, child.key)
+			}
+			if !matchFilter(child.value, root, matched) {
+				continue
+			}
+			if err := c.walkStep(child.value, root, step+1, path+child.path, depth+1, st, visit); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("expression don't support in filter")
+	}
+	return nil
+}
+
+// walkScan handles recursive descent: the rest of the path is matched against
+// obj and all of its descendants. A trailing scan matches every descendant.
+func (c *Compiled) walkScan(obj, root interface{}, step int, path string, depth int, st *walkState, visit visitor) error {
+	last := step == len(c.operations)-1
+	if !last {
+		next := c.operations[step+1]
+		// keyed operations on an array are matched by its elements, which are
+		// visited below anyway
+		if !(reflect.TypeOf(obj).Kind() == reflect.Slice && len(next.key) > 0) {
+			if err := c.walkStep(obj, root, step+1, path, depth, st, visit); err != nil {
+				return err
+			}
+		}
+	}
+	if !st.seen.enter(obj) {
+		return nil
+	}
+	defer st.seen.leave(obj)
+	for _, child := range children(obj) {
+		if last {
+			if err := visit(path+child.path, depth+1, child.value); err != nil {
+				return err
+			}
+		}
+		if err := c.walkStep(child.value, root, step, path+child.path, depth+1, st, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type node struct {
+	path  string
+	value interface{}
+	// key is the map key or struct field name of the node, if any
+	key string
+	// field is the index of the struct field of the node, if any
+	field int
+}
+
+// children returns the members of a map, sorted by key, or the elements of an
+// array, each with the path segment that leads to it.
+func children(obj interface{}) []node {
+	if reflect.TypeOf(obj) == nil {
+		return nil
+	}
+	v := reflect.ValueOf(obj)
+	switch v.Kind() {
+	case reflect.Map:
+		keys := make([]string, 0, v.Len())
+		values := make(map[string]interface{}, v.Len())
+		for _, kv := range v.MapKeys() {
+			key := mapKeyString(kv)
+			keys = append(keys, key)
+			values[key] = v.MapIndex(kv).Interface()
+		}
+		sort.Strings(keys)
+		res := make([]node, 0, len(keys))
+		for _, key := range keys {
+			res = append(res, node{path: keySegment(key), value: values[key], key: key})
+		}
+		return res
+	case reflect.Slice:
+		res := make([]node, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			res = append(res, node{path: fmt.Sprintf("[%d]", i), value: v.Index(i).Interface()})
+		}
+		return res
+	case reflect.Struct, reflect.Ptr:
+		return structFields(obj)
+	}
+	return nil
+}
+
+// ancestors holds the pointers and maps on the way from the root of a traversal
+// to the current node, so that a struct pointing back to one of its parents
+// doesn't make the traversal recurse forever.
+type ancestors map[ancestor]bool
+
+type ancestor struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+// enter adds obj to the ancestors, or reports false if it already is one, i.e.
+// obj is part of a cycle. Values other than pointers and maps are always
+// entered and need no leave.
+func (a ancestors) enter(obj interface{}) bool {
+	key, ok := ancestorOf(obj)
+	if !ok {
+		return true
+	}
+	if a[key] {
+		return false
+	}
+	a[key] = true
+	return true
+}
+
+func (a ancestors) leave(obj interface{}) {
+	if key, ok := ancestorOf(obj); ok {
+		delete(a, key)
+	}
+}
+
+func ancestorOf(obj interface{}) (ancestor, bool) {
+	v := reflect.ValueOf(obj)
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Map) && !v.IsNil() {
+		return ancestor{ptr: v.Pointer(), typ: v.Type()}, true
+	}
+	return ancestor{}, false
+}
+
+// structFields returns the exported fields of a struct, or of a pointer to a
+// struct, in declaration order. Fields are named after their json tag, and
+// fields tagged `json:"-"` are skipped, like encoding/json does.
+func structFields(obj interface{}) []node {
+	v := reflect.ValueOf(obj)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	res := make([]node, 0, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			if tag == "-" {
+				continue
+			}
+			if tagName := strings.Split(tag, ",")[0]; tagName != "" {
+				name = tagName
+			}
+		}
+		res = append(res, node{path: keySegment(name), value: v.Field(i).Interface(), key: name, field: i})
+	}
+	return res
+}
+
+// isWildcard reports whether operation is a `[*]` range over all elements.
+func isWildcard(operation operation) bool {
+	args, ok := operation.args.([2]interface{})
+	return operation.op == "range" && ok && args[0] == nil && args[1] == nil
+}
+
+// keySegment returns the path segment of a map key: `.key`, or `['key']` for
+// keys containing characters that have a meaning in paths.
+func keySegment(key string) string {
+	if key != "" && !strings.ContainsAny(key, ".[]()'\"*?@$ \t\n\\") {
+		return "." + key
+	}
+	key = strings.ReplaceAll(key, `\`, `\\`)
+	key = strings.ReplaceAll(key, `'`, `\'`)
+	return "['" + key + "']"
+}
+
+// WalkAll visits every node of obj, not only the matches of a path, and lets
+// visit replace any of them in place. Nodes are visited depth first, parents
+// before their children: the root as `$`, then map members sorted by key, array
+// elements by index and struct fields in declaration order, each with its
+// concrete path like `$.store.book[0].title`.
+//
+// If visit returns replace, the node is set to newValue and its original
+// children are not visited; newValue itself is not walked either. The children
+// of a node are collected before they are visited, so replacing them never
+// affects which nodes are visited. Maps and slices are updated in place, struct
+// fields only when reached through a pointer. WalkAll returns the root, which
+// is newValue if the root itself was replaced. A node that is one of its own
+// ancestors, like a struct pointing back to its parent, is visited but not
+// descended into again.
+func WalkAll(obj interface{}, visit func(path string, value interface{}) (newValue interface{}, replace bool)) (interface{}, error) {
+	if newValue, replace := visit("$", obj); replace {
+		return newValue, nil
+	}
+	return obj, walkAll(obj, "$", visit, ancestors{})
+}
+
+func walkAll(obj interface{}, path string, visit func(path string, value interface{}) (interface{}, bool), seen ancestors) error {
+	if !seen.enter(obj) {
+		return nil
+	}
+	defer seen.leave(obj)
+	for i, child := range children(obj) {
+		childPath := path + child.path
+		if newValue, replace := visit(childPath, child.value); replace {
+			if err := replaceChild(obj, i, child, newValue); err != nil {
+				return fmt.Errorf("%s: %w", childPath, err)
+			}
+			continue
+		}
+		if err := walkAll(child.value, childPath, visit, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceChild sets the i-th child of obj, as returned by children, to value.
+func replaceChild(obj interface{}, i int, child node, value interface{}) error {
+	v := reflect.ValueOf(obj)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	var target reflect.Value
+	var elemType reflect.Type
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("%w: cannot set non-string key %s", NotMap, child.key)
+		}
+		elemType = v.Type().Elem()
+	case reflect.Slice:
+		target = v.Index(i)
+		elemType = target.Type()
+	case reflect.Struct:
+		target = v.Field(child.field)
+		if !target.CanSet() {
+			return fmt.Errorf("cannot set field %s of a struct value", child.key)
+		}
+		elemType = target.Type()
+	}
+	val := reflect.Zero(elemType)
+	if value != nil {
+		val = reflect.ValueOf(value)
+		if !val.Type().AssignableTo(elemType) {
+			return fmt.Errorf("%w: cannot assign %T to %v", ErrTypeMismatch, value, elemType)
+		}
+	}
+	if v.Kind() == reflect.Map {
+		v.SetMapIndex(reflect.ValueOf(child.key).Convert(v.Type().Key()), val)
+		return nil
+	}
+	target.Set(val)
+	return nil
+}
+
+// Flatten returns every leaf of obj keyed by its concrete path, e.g.
+// `$.store.book[0].price` => 8.95. Empty objects and arrays are kept as leaves,
+// and a scalar obj is returned as `$`. The descent stops at reference cycles,
+// so a node that is one of its own ancestors yields no leaves.
+func Flatten(obj interface{}) map[string]interface{} {
+	res := make(map[string]interface{})
+	flatten(obj, "$", res, ancestors{})
+	return res
+}
+
+func flatten(obj interface{}, path string, res map[string]interface{}, seen ancestors) {
+	nodes := children(obj)
+	if len(nodes) == 0 {
+		res[path] = obj
+		return
+	}
+	if !seen.enter(obj) {
+		return
+	}
+	defer seen.leave(obj)
+	for _, n := range nodes {
+		flatten(n.value, path+n.path, res, seen)
+	}
+}
+
+// DuplicatePathPolicy controls what Unflatten and Merge do when two paths
+// target the same location in incompatible ways, like `$.a` and `$.a.b`.
+type DuplicatePathPolicy int
+
+const (
+	// DuplicateError fails on the conflicting path.
+	DuplicateError DuplicatePathPolicy = iota
+	// DuplicateLastWins keeps the value set last.
+	DuplicateLastWins
+	// DuplicateFirstWins keeps the value set first.
+	DuplicateFirstWins
+)
+
+// WithDuplicatePolicy sets what Unflatten and Merge do with conflicting paths.
+// Unflatten defaults to DuplicateError, Merge to DuplicateLastWins, which
+// replaces the values of dst that are in the way.
+func WithDuplicatePolicy(policy DuplicatePathPolicy) Option {
+	return func(o *options) {
+		o.onDuplicate = policy
+	}
+}
+
+// Unflatten rebuilds a document from the concrete paths produced by Flatten,
+// creating a map[string]interface{} for every key and a []interface{} for
+// every index. Missing array elements are filled with nil. Paths are applied
+// in sorted order; paths conflicting with each other, like `$.a` and `$.a.b`
+// or `$.a` and `$.a[0]`, are resolved according to WithDuplicatePolicy.
+func Unflatten(pairs map[string]interface{}, opts ...Option) (interface{}, error) {
+	policy := newOptions(opts).onDuplicate
+	paths := make([]string, 0, len(pairs))
+	for path := range pairs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var root interface{}
+	exists := false
+	for _, path := range paths {
+		segments, err := splitConcretePath(path)
+		if err != nil {
+			return nil, err
+		}
+		root, err = unflattenSet(root, exists, segments, pairs[path], path, policy)
+		if err != nil {
+			return nil, err
+		}
+		exists = true
+	}
+	fillGaps(root)
+	return root, nil
+}
+
+// gap marks the elements Unflatten adds to reach an index, so that they are
+// not mistaken for an explicit null. fillGaps replaces them with nil.
+type gap struct{}
+
+func fillGaps(node interface{}) {
+	switch x := node.(type) {
+	case map[string]interface{}:
+		for _, value := range x {
+			fillGaps(value)
+		}
+	case []interface{}:
+		for i, value := range x {
+			if value == (gap{}) {
+				x[i] = nil
+			} else {
+				fillGaps(value)
+			}
+		}
+	}
+}
+
+func unflattenSet(node interface{}, exists bool, segments []pathSegment, value interface{}, path string, policy DuplicatePathPolicy) (interface{}, error) {
+	if len(segments) == 0 {
+		if exists {
+			return resolveDuplicate(policy, node, value, fmt.Errorf("conflicting path: %s is set more than once", path))
+		}
+		return value, nil
+	}
+	segment := segments[0]
+	if segment.isIdx {
+		arr, ok := node.([]interface{})
+		if exists && !ok {
+			if policy != DuplicateLastWins {
+				return resolveDuplicate(policy, node, nil, fmt.Errorf("conflicting path: %s expects an array", path))
+			}
+			arr = nil
+		}
+		for len(arr) <= segment.idx {
+			arr = append(arr, gap{})
+		}
+		current := arr[segment.idx]
+		if current == (gap{}) {
+			current = nil
+		}
+		child, err := unflattenSet(current, arr[segment.idx] != (gap{}), segments[1:], value, path, policy)
+		if err != nil {
+			return nil, err
+		}
+		arr[segment.idx] = child
+		return arr, nil
+	}
+	obj, ok := node.(map[string]interface{})
+	if exists && !ok {
+		if policy != DuplicateLastWins {
+			return resolveDuplicate(policy, node, nil, fmt.Errorf("conflicting path: %s expects an object", path))
+		}
+		obj = nil
+	}
+	if obj == nil {
+		obj = make(map[string]interface{})
+	}
+	current, childExists := obj[segment.key]
+	child, err := unflattenSet(current, childExists, segments[1:], value, path, policy)
+	if err != nil {
+		return nil, err
+	}
+	obj[segment.key] = child
+	return obj, nil
+}
+
+// resolveDuplicate returns the value to keep at a location set by two paths
+// according to policy: err, the current value or the new value.
+func resolveDuplicate(policy DuplicatePathPolicy, current, value interface{}, err error) (interface{}, error) {
+	switch policy {
+	case DuplicateLastWins:
+		return value, nil
+	case DuplicateFirstWins:
+		return current, nil
+	default:
+		return nil, err
+	}
+}
+
+type pathSegment struct {
+	key   string
+	idx   int
+	isIdx bool
+}
+
+// splitConcretePath splits a concrete path like `$.a[0]['b.c']`, as produced by
+// Flatten, into its keys and indices.
+func splitConcretePath(path string) ([]pathSegment, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("path should start with '$': %s", path)
+	}
+	segments := make([]pathSegment, 0)
+	for i := 1; i < len(path); {
+		switch path[i] {
+		case '.':
+			j := i + 1
+			for j < len(path) && path[j] != '.' && path[j] != '[' {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("empty key at %d: %s", i, path)
+			}
+			segments = append(segments, pathSegment{key: path[i+1 : j]})
+			i = j
+		case '[':
+			if i+1 < len(path) && path[i+1] == '\'' {
+				var key strings.Builder
+				j := i + 2
+				for ; j < len(path) && path[j] != '\''; j++ {
+					if path[j] == '\\' && j+1 < len(path) {
+						j++
+					}
+					key.WriteByte(path[j])
+				}
+				if j+1 >= len(path) || path[j+1] != ']' {
+					return nil, fmt.Errorf("unterminated quoted key at %d: %s", i, path)
+				}
+				segments = append(segments, pathSegment{key: key.String()})
+				i = j + 2
+				continue
+			}
+			j := strings.IndexByte(path[i:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated index at %d: %s", i, path)
+			}
+			idx, err := strconv.Atoi(path[i+1 : i+j])
+			if err != nil || idx < 0 {
+				return nil, fmt.Errorf("invalid index at %d: %s", i, path)
+			}
+			segments = append(segments, pathSegment{idx: idx, isIdx: true})
+			i += j + 1
+		default:
+			return nil, fmt.Errorf("invalid char at %d: %s", i, path)
+		}
+	}
+	return segments, nil
+}
+
+// selectIndices returns the indices of an array of the given length selected
+// by an "idx" or "range" operation, with the same semantics as getByIdx and
+// getByRangeArgs.
+func selectIndices(length int, operation operation) ([]int, error) {
+	if operation.op == "idx" {
+		idxs, ok := operation.args.([]int)
+		if script, isScript := operation.args.(scriptIndex); isScript {
+			idx, err := script.eval(length)
+			if err != nil {
+				return nil, err
+			}
+			idxs, ok = []int{idx}, true
+		}
+		if !ok {
+			return nil, fmt.Errorf("invalid index args: %v", operation.args)
+		}
+		res := make([]int, 0, len(idxs))
+		for _, idx := range idxs {
+			if idx < 0 {
+				idx += length
+			}
+			if idx < 0 || idx >= length {
+				return nil, fmt.Errorf("%w: index out of range: len: %v, idx: %v", ErrNotFound, length, idx)
+			}
+			res = append(res, idx)
+		}
+		return res, nil
+	}
+	all := make([]int, length)
+	for i := range all {
+		all[i] = i
+	}
+	selected, err := getByRangeArgs(all, operation.args)
+	if err != nil {
+		return nil, err
+	}
+	v := reflect.ValueOf(selected)
+	res := make([]int, v.Len())
+	for i := range res {
+		res[i] = v.Index(i).Interface().(int)
+	}
+	return res, nil
+}
+
+func (c *Compiled) Set(obj interface{}, val interface{}) error {
+	if len(c.operations) < 1 {
+		return fmt.Errorf("need at least one levels to set value")
+	}
+	if c.opts.numbersAsFloat64 {
+		val = NormalizeNumbers(val)
+	}
+	sub := Compiled{operations: c.operations[0 : len(c.operations)-1], opts: c.opts}
+
+	parent, err := sub._Lookup(obj)
+	if err != nil {
+		return err
 	}
 
 	lastStep := c.operations[len(c.operations)-1]
 	switch lastStep.op {
 	case "key":
+		if idx, ok := c.numericKey(lastStep); ok && reflect.TypeOf(parent) != nil && reflect.TypeOf(parent).Kind() == reflect.Slice {
+			return setByIdx(parent, idx, val)
+		}
 		return setByKey(parent, lastStep.key, val)
 	case "idx":
+		holder := parent
 		if len(lastStep.key) > 0 {
 			// no key `$[0].test`
-			parent, err = _getByKey(parent, lastStep.key)
+			parent, err = c._getByKey(parent, lastStep.key)
+			if err != nil {
+				return err
+			}
+		}
+		idxs, err := indexArgs(parent, lastStep)
+		if err != nil {
+			return err
+		}
+		if len(idxs) > 1 {
+			return fmt.Errorf("cannot set multiple items")
+		} else if len(idxs) == 1 {
+			if c.opts.growArrays && len(lastStep.key) > 0 && reflect.TypeOf(parent) != nil &&
+				reflect.TypeOf(parent).Kind() == reflect.Slice && idxs[0] >= reflect.ValueOf(parent).Len() {
+				return growAndSet(holder, lastStep.key, parent, idxs[0], val)
+			}
+			return setByIdx(parent, idxs[0], val)
+		} else {
+			return fmt.Errorf("cannot set on empty slice")
+		}
+	default:
+		return fmt.Errorf("set must point to specific position")
+	}
+}
+
+// GetParent returns the object or array holding the value path points to, like
+// the book of `$.store.book[0].title`. The parent is resolved like Set resolves
+// the container to set in. path must match a single existing value; paths with
+// wildcards, filters, slices or several indices are rejected as ambiguous.
+func GetParent(obj interface{}, path string) (*Result, error) {
+	c, err := Compile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.operations) < 1 {
+		return nil, fmt.Errorf("the root has no parent")
+	}
+	for _, o := range c.operations {
+		if o.op != "key" && o.op != "idx" || len(indexArgsOf(o)) > 1 {
+			return nil, fmt.Errorf("parent of %s is ambiguous, path should match a single value", path)
+		}
+	}
+	_, isArray, err := c.Lookup(obj)
+	if err != nil {
+		return nil, err
+	}
+	if isArray {
+		return nil, fmt.Errorf("parent of %s is ambiguous, path should match a single value", path)
+	}
+
+	sub := Compiled{operations: c.operations[0 : len(c.operations)-1], opts: c.opts}
+	parent, err := sub._Lookup(obj)
+	if err != nil {
+		return nil, err
+	}
+	// the parent of `$.book[0]` is the book array
+	if lastStep := c.operations[len(c.operations)-1]; lastStep.op == "idx" && len(lastStep.key) > 0 {
+		if parent, err = c._getByKey(parent, lastStep.key); err != nil {
+			return nil, err
+		}
+	}
+	return &Result{value: parent}, nil
+}
+
+// Node is a cursor on a value resolved once by Resolve, to fetch several of its
+// members without resolving the path leading to it again.
+type Node struct {
+	path  string
+	value interface{}
+}
+
+// Resolve looks up prefixPath, which must match a single value, and returns a
+// Node on it, e.g. `$.store.book[0]` to then fetch its title and price.
+func Resolve(obj interface{}, prefixPath string) (*Node, error) {
+	c, err := Compile(prefixPath)
+	if err != nil {
+		return nil, err
+	}
+	value, isArray, err := c.Lookup(obj)
+	if err != nil {
+		return nil, err
+	}
+	if isArray {
+		return nil, fmt.Errorf("%s matches several values, it should match a single one", prefixPath)
+	}
+	return &Node{path: prefixPath, value: value}, nil
+}
+
+// Value returns the value of the node.
+func (n *Node) Value() interface{} {
+	return n.value
+}
+
+// Path returns the path of the node: the prefix given to Resolve followed by
+// the keys and indices fetched since.
+func (n *Node) Path() string {
+	return n.path
+}
+
+// Get returns a Node on the member key of the node, which must be an object.
+func (n *Node) Get(key string) (*Node, error) {
+	value, err := decodeRaw(n.value)
+	if err != nil {
+		return nil, err
+	}
+	if value != nil && reflect.TypeOf(value).Kind() == reflect.Slice {
+		return nil, NotMap
+	}
+	value, err = _getByKey(value, key)
+	if err != nil {
+		return nil, err
+	}
+	return &Node{path: n.path + keySegment(key), value: value}, nil
+}
+
+// Index returns a Node on the element i of the node, which must be an array.
+// Negative indices count from the end.
+func (n *Node) Index(i int) (*Node, error) {
+	if n.value == nil {
+		return nil, IsNull
+	}
+	value, err := getByIdx(n.value, i)
+	if err != nil {
+		return nil, err
+	}
+	return &Node{path: fmt.Sprintf("%s[%d]", n.path, i), value: value}, nil
+}
+
+// SetIf sets path to val only if its current value deep-equals expected, and
+// reports whether the value was set.
+func SetIf(obj interface{}, path string, expected, val interface{}) (bool, error) {
+	c, err := Compile(path)
+	if err != nil {
+		return false, err
+	}
+	current, _, err := c.Lookup(obj)
+	if err != nil {
+		return false, err
+	}
+	if !reflect.DeepEqual(current, expected) {
+		return false, nil
+	}
+	if err := c.Set(obj, val); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetReport compiles path and calls Compiled.SetReport.
+func SetReport(obj interface{}, path string, val interface{}, opts ...Option) (bool, error) {
+	c, err := Compile(path, opts...)
+	if err != nil {
+		return false, err
+	}
+	return c.SetReport(obj, val)
+}
+
+// SetReport works like Set, but skips the write when the current value already
+// deep-equals val, and reports whether the value was changed.
+func (c *Compiled) SetReport(obj interface{}, val interface{}) (bool, error) {
+	if c.opts.numbersAsFloat64 {
+		val = NormalizeNumbers(val)
+	}
+	if current, _, err := c.Lookup(obj); err == nil && reflect.DeepEqual(current, val) {
+		return false, nil
+	}
+	if err := c.Set(obj, val); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// NormalizeNumbers converts every number of v, including those nested in
+// []interface{} and map[string]interface{}, to float64 like encoding/json
+// decodes them. Numbers that don't fit a float64, such as json.Number values
+// out of range, are kept as is.
+func NormalizeNumbers(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(x))
+		for key, value := range x {
+			res[key] = NormalizeNumbers(value)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(x))
+		for i, value := range x {
+			res[i] = NormalizeNumbers(value)
+		}
+		return res
+	case json.Number:
+		if f, err := x.Float64(); err == nil {
+			return f
+		}
+		return v
+	case string:
+		return v
+	}
+	if isNumber(v) {
+		if f, err := toFloat64(v); err == nil {
+			return f
+		}
+	}
+	return v
+}
+
+// OnMissing is called by SetMany for each path that cannot be set.
+type OnMissing func(path string, err error)
+
+// SetMany sets every path of values on obj, in sorted path order. If onMissing
+// is nil the first failure aborts the batch, otherwise onMissing is called for
+// each failed path and the remaining paths are still applied.
+func SetMany(obj interface{}, values map[string]interface{}, onMissing OnMissing) error {
+	paths := make([]string, 0, len(values))
+	for path := range values {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := Set(obj, path, values[path]); err != nil {
+			if onMissing == nil {
+				return err
+			}
+			onMissing(path, err)
+		}
+	}
+	return nil
+}
+
+// ArrayMergeMode controls how Merge combines an array of src with the array
+// found at the same path of dst.
+type ArrayMergeMode int
+
+const (
+	// ArrayReplace replaces the array of dst with the array of src.
+	ArrayReplace ArrayMergeMode = iota
+	// ArrayAppend appends the elements of the array of src to the array of dst.
+	ArrayAppend
+)
+
+// WithArrayMerge sets how Merge combines an array of src with the array of dst
+// at the same path. Defaults to ArrayReplace.
+func WithArrayMerge(mode ArrayMergeMode) Option {
+	return func(o *options) {
+		o.arrayMerge = mode
+	}
+}
+
+// Merge overlays src onto dst, which both have to be objects. Every leaf path
+// of src is set into dst, creating the missing intermediate objects. Arrays are
+// merged as a whole according to WithArrayMerge, and an empty object of src leaves
+// an object of dst untouched. A value of src whose path goes through, or ends
+// at, a value of dst of another kind, like a string of dst where src has an
+// object, replaces it, unless another policy is set with WithDuplicatePolicy,
+// src being set last. With DuplicateError, conflicts are looked for before
+// anything is written, so that dst is left untouched on error.
+func Merge(dst, src interface{}, opts ...Option) error {
+	o := newOptions(append([]Option{WithDuplicatePolicy(DuplicateLastWins)}, opts...))
+	root, ok := dst.(map[string]interface{})
+	if !ok {
+		return NotMap
+	}
+	if _, ok := src.(map[string]interface{}); !ok {
+		return NotMap
+	}
+	leaves := make(map[string]interface{})
+	mergeLeaves(src, "$", leaves, ancestors{})
+	paths := make([]string, 0, len(leaves))
+	for path := range leaves {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	merge := func(write bool) error {
+		for _, path := range paths {
+			segments, err := splitConcretePath(path)
 			if err != nil {
 				return err
 			}
+			if err := mergeSet(root, segments, leaves[path], path, o, write); err != nil {
+				return err
+			}
 		}
-		if len(lastStep.args.([]int)) > 1 {
-			return fmt.Errorf("cannot set multiple items")
-		} else if len(lastStep.args.([]int)) == 1 {
-			return setByIdx(parent, lastStep.args.([]int)[0], val)
-		} else {
-			return fmt.Errorf("cannot set on empty slice")
+		return nil
+	}
+	if o.onDuplicate == DuplicateError {
+		if err := merge(false); err != nil {
+			return err
+		}
+	}
+	return merge(true)
+}
+
+// mergeLeaves is like flatten, but keeps arrays as leaves so that Merge can
+// combine them as a whole.
+func mergeLeaves(obj interface{}, path string, res map[string]interface{}, seen ancestors) {
+	if _, ok := obj.([]interface{}); ok {
+		res[path] = obj
+		return
+	}
+	nodes := children(obj)
+	if len(nodes) == 0 {
+		if path != "$" {
+			res[path] = obj
+		}
+		return
+	}
+	if !seen.enter(obj) {
+		return
+	}
+	defer seen.leave(obj)
+	for _, n := range nodes {
+		mergeLeaves(n.value, path+n.path, res, seen)
+	}
+}
+
+// mergeSet sets value at segments of obj. Without write, it only reports the
+// conflicts that setting it would raise.
+func mergeSet(obj map[string]interface{}, segments []pathSegment, value interface{}, path string, o options, write bool) error {
+	key := segments[0].key
+	current := obj[key]
+	if len(segments) > 1 {
+		child, ok := current.(map[string]interface{})
+		if !ok {
+			if current != nil {
+				switch o.onDuplicate {
+				case DuplicateError:
+					return fmt.Errorf("conflicting path: %s expects an object", path)
+				case DuplicateFirstWins:
+					return nil
+				}
+			}
+			if !write {
+				// the rest of the path is created, nothing can conflict
+				return nil
+			}
+			child = make(map[string]interface{})
+			obj[key] = child
+		}
+		return mergeSet(child, segments[1:], value, path, o, write)
+	}
+	switch v := value.(type) {
+	case []interface{}:
+		if arr, ok := current.([]interface{}); ok {
+			if !write {
+				return nil
+			}
+			if o.arrayMerge == ArrayAppend {
+				obj[key] = append(arr, v...)
+			} else {
+				obj[key] = value
+			}
+			return nil
+		}
+	case map[string]interface{}:
+		if _, ok := current.(map[string]interface{}); ok {
+			return nil
 		}
 	default:
-		return fmt.Errorf("set must point to specific position")
+		if !isContainer(current) {
+			if write {
+				obj[key] = value
+			}
+			return nil
+		}
+	}
+	if current == nil {
+		if write {
+			obj[key] = value
+		}
+		return nil
+	}
+	merged, err := resolveDuplicate(o.onDuplicate, current, value, fmt.Errorf("conflicting path: %s has another kind in dst", path))
+	if err != nil || !write {
+		return err
 	}
+	obj[key] = merged
 	return nil
 }
 
 func parse(query string) ([]string, error) {
-	fragments := make([]string, 0)
+	return parseWith(query, '.')
+}
+
+// parseWith splits query into fragments separated by delimiter, which is '.'
+// for regular paths.
+func parseWith(query string, delimiter byte) ([]string, error) {
+	dot := string(delimiter)
+	fragments := make([]string, 0, strings.Count(query, dot)+1)
+	// the current fragment is always query[start:], sliced instead of built up
+	// char by char to avoid allocating
+	start := 0
 	fragment := ""
 
 	for idx, x := range query {
-		fragment += string(x)
+		fragment = query[start : idx+utf8.RuneLen(x)]
 		if idx == 0 {
 			if fragment == "$" || fragment == "@" {
 				fragments = append(fragments, fragment[:])
-				fragment = ""
+				start = idx + 1
 				continue
 			} else {
 				return nil, fmt.Errorf("should start with '$'")
 			}
 		}
-		if fragment == "." {
+		if fragment == dot {
 			continue
-		} else if fragment == ".." {
+		} else if fragment == dot+dot {
 			if fragments[len(fragments)-1] != "*" {
 				fragments = append(fragments, "*")
 			}
-			fragment = "."
+			start = idx
 			continue
 		} else {
 			if strings.Contains(fragment, "[") {
-				if x == ']' && !strings.HasSuffix(fragment, "\\]") {
-					if fragment[0] == '.' {
+				if x == ']' && !strings.HasSuffix(fragment, "\\]") && bracketsClosed(fragment) {
+					if fragment[0] == delimiter {
 						fragments = append(fragments, fragment[1:])
 					} else {
 						fragments = append(fragments, fragment[:])
 					}
-					fragment = ""
+					start = idx + 1
 					continue
 				}
 			} else {
-				if x == '.' {
-					if fragment[0] == '.' {
+				if x == rune(delimiter) {
+					if fragment[0] == delimiter {
 						fragments = append(fragments, fragment[1:len(fragment)-1])
 					} else {
 						fragments = append(fragments, fragment[:len(fragment)-1])
 					}
-					fragment = "."
+					start = idx
 					continue
 				}
 			}
 		}
 	}
+	if len(fragments) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+	fragment = query[start:]
+	if fragment == dot {
+		return nil, fmt.Errorf("path should not end with '%s' or '%s': %s", dot, dot+dot, query)
+	}
 	if len(fragment) > 0 {
-		if fragment[0] == '.' {
+		if fragment[0] == delimiter {
 			fragment = fragment[1:]
 			if fragment != "*" {
 				fragments = append(fragments, fragment[:])
@@ -625,6 +3135,26 @@ func parse(query string) ([]string, error) {
 	return fragments, nil
 }
 
+// bracketsClosed reports whether every unescaped `[` of fragment outside of
+// quotes is closed, so that nested filters like `[?(@.books[?(@.price < 5)])]` stay one fragment.
+func bracketsClosed(fragment string) bool {
+	depth, quoted := 0, false
+	for i := 0; i < len(fragment); i++ {
+		switch c := fragment[i]; {
+		case c == '\\':
+			i++
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
 /*
  op: "root", "key", "idx", "range", "filter", "scan"
 */
@@ -659,8 +3189,8 @@ func parseFragment(token string) (op string, key string, args interface{}, err e
 			// range ----------------------------------------------
 			op = "range"
 			tails := strings.Split(tail, ":")
-			if len(tails) != 2 {
-				err = fmt.Errorf("only support one range(from, to): %v", tails)
+			if len(tails) != 2 && len(tails) != 3 {
+				err = fmt.Errorf("only support one range(from, to[, step]): %v", tails)
 				return
 			}
 			var frm interface{}
@@ -677,12 +3207,32 @@ func parseFragment(token string) (op string, key string, args interface{}, err e
 				}
 				to = nil
 			}
+			if len(tails) == 3 {
+				var step interface{}
+				if step, err = strconv.Atoi(strings.Trim(tails[2], " ")); err != nil {
+					if strings.Trim(tails[2], " ") == "" {
+						err = nil
+					}
+					step = nil
+				}
+				if step == 0 {
+					err = fmt.Errorf("range step cannot be zero")
+					return
+				}
+				args = [3]interface{}{frm, to, step}
+				return
+			}
 			args = [2]interface{}{frm, to}
 			return
 		} else if tail == "*" {
 			op = "range"
 			args = [2]interface{}{nil, nil}
 			return
+		} else if strings.HasPrefix(tail, "(") && strings.HasSuffix(tail, ")") {
+			// script index -----------------------------------------
+			op = "idx"
+			args, err = parseScriptIndex(tail[1 : len(tail)-1])
+			return
 		} else {
 			// idx ------------------------------------------------
 			op = "idx"
@@ -701,66 +3251,257 @@ func parseFragment(token string) (op string, key string, args interface{}, err e
 }
 
 func filterGetFromExplicitPath(obj interface{}, path string) (interface{}, error) {
-	steps, err := parse(path)
+	return filterGetFromPath(obj, obj, path)
+}
+
+// filterGetFromPath resolves a path of a filter expression against obj. Nested
+// filters like `@.books[?(@.price < 5)]` are evaluated against root, and match
+// nothing if none of the elements matches.
+//
+// Steps may be written with optional chaining like `@?.a?.b`, which resolves
+// like `@.a.b`: a missing or null intermediate is reported as not found, which
+// makes the expression a non-match rather than an error.
+func filterGetFromPath(obj, root interface{}, path string) (interface{}, error) {
+	steps, err := parse(stripOptionalChaining(path))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPath, err)
 	}
 	if steps[0] != "@" && steps[0] != "$" {
-		return nil, fmt.Errorf("$ or @ should in front of path")
+		return nil, fmt.Errorf("%w: $ or @ should in front of path", ErrInvalidPath)
 	}
 	steps = steps[1:]
 	xobj := obj
+	var plain Compiled
+	// whether xobj is the array of values of a key applied to an array
+	spread := false
 	for _, s := range steps {
+		// `@['a.b']` is a single key containing a dot
+		if key, quoted, ok := quotedKey(s); ok {
+			if key != "" {
+				if xobj, spread, err = plain.getByKeyFrom(xobj, key, spread); err != nil {
+					return nil, err
+				}
+			}
+			if xobj, err = decodeRaw(xobj); err != nil {
+				return nil, err
+			}
+			if xobj, spread, err = plain.getByKeyFrom(xobj, quoted, spread); err != nil {
+				return nil, err
+			}
+			continue
+		}
 		op, key, args, err := parseFragment(s)
 		// "key", "idx"
 		switch op {
 		case "key":
-			xobj, err = _getByKey(xobj, key)
+			// `@.items.length` is the size of an array, unless its elements
+			// have a `length` key of their own
+			if xobj, err = decodeRaw(xobj); err != nil {
+				return nil, err
+			}
+			if key == "length" && xobj != nil && reflect.TypeOf(xobj).Kind() == reflect.Slice && !elementsHaveKey(xobj, key) {
+				xobj, spread = reflect.ValueOf(xobj).Len(), false
+				continue
+			}
+			xobj, spread, err = plain.getByKeyFrom(xobj, key, spread)
 			if err != nil {
 				return nil, err
 			}
+			continue
 		case "idx":
-			if len(args.([]int)) != 1 {
-				return nil, fmt.Errorf("don't support multiple index in filter")
+			if len(key) > 0 {
+				xobj, err = _getByKey(xobj, key)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if xobj == nil {
+				return nil, ErrGetFromNullObj
+			}
+			idxs, err := indexArgs(xobj, operation{op: op, key: key, args: args})
+			if err != nil {
+				return nil, err
+			}
+			if len(idxs) != 1 {
+				return nil, fmt.Errorf("%w: don't support multiple index in filter", ErrInvalidPath)
+			}
+			xobj, err = getByIdx(xobj, idxs[0])
+			if err != nil {
+				return nil, err
+			}
+		case "range":
+			// `@.friends[*].name` resolves to an array
+			if len(key) > 0 {
+				xobj, spread, err = plain.getByKeyFrom(xobj, key, spread)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if xobj == nil {
+				return nil, ErrGetFromNullObj
+			}
+			if spread {
+				// `friends[*]` of every dog, like Lookup applies the range
+				// to each of them
+				res := make([]interface{}, 0)
+				for _, value := range xobj.([]interface{}) {
+					if !isArrayValue(value) {
+						continue
+					}
+					selected, err := getByRangeArgs(value, args)
+					if err != nil {
+						continue
+					}
+					v := reflect.ValueOf(selected)
+					for i := 0; i < v.Len(); i++ {
+						res = append(res, v.Index(i).Interface())
+					}
+				}
+				xobj = res
+				continue
 			}
-			xobj, err = _getByKey(xobj, key)
+			xobj, err = getByRangeArgs(xobj, args)
 			if err != nil {
 				return nil, err
 			}
-			xobj, err = getByIdx(xobj, args.([]int)[0])
+		case "filter":
+			if len(key) > 0 {
+				xobj, err = _getByKey(xobj, key)
+				if err != nil {
+					return nil, err
+				}
+			}
+			filtered, err := getFiltered(xobj, root, args.(string))
 			if err != nil {
 				return nil, err
 			}
+			if len(filtered) == 0 {
+				return nil, fmt.Errorf("%w: %s", ErrNotFound, s)
+			}
+			xobj = filtered
 		default:
-			return nil, fmt.Errorf("expression don't support in filter")
+			return nil, fmt.Errorf("%w: expression don't support in filter", ErrInvalidPath)
 		}
+		spread = false
 	}
 	return xobj, nil
 }
 
+// Getter is implemented by values that resolve their own keys, like lazily
+// loaded rows or generated messages, so that paths can traverse them without
+// converting them to maps first. JSONPathGet returns the value of key, and
+// whether key exists.
+//
+// Keys are looked up through Getter before any reflection, so a map or struct
+// type implementing it is never read directly.
+type Getter interface {
+	JSONPathGet(key string) (value interface{}, ok bool)
+}
+
+// getByGetter looks up key through a Getter.
+func getByGetter(g Getter, key string) (interface{}, error) {
+	value, ok := g.JSONPathGet(key)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s not found in object", ErrNotFound, key)
+	}
+	return value, nil
+}
+
 func getByKey(obj interface{}, key string) (interface{}, error) {
+	obj, err := decodeRaw(obj)
+	if err != nil {
+		return nil, err
+	}
+	if g, ok := obj.(Getter); ok {
+		return getByGetter(g, key)
+	}
 	if reflect.TypeOf(obj).Kind() != reflect.Map {
 		return nil, NotMap
 	}
 	if json, ok := obj.(map[string]interface{}); ok {
 		value, exists := json[key]
 		if !exists {
-			return nil, fmt.Errorf("no match: %s not found in object", key)
+			return nil, fmt.Errorf("%w: %s not found in object", ErrNotFound, key)
 		}
 		return value, nil
 	}
 	for _, kv := range reflect.ValueOf(obj).MapKeys() {
-		if kv.String() == key {
+		if mapKeyString(kv) == key {
 			return reflect.ValueOf(obj).MapIndex(kv).Interface(), nil
 		}
 	}
-	return nil, fmt.Errorf("no match: %s not found in object", key)
+	return nil, fmt.Errorf("%w: %s not found in object", ErrNotFound, key)
+}
+
+// decodeRaw unmarshals a json.RawMessage, such as the values of a partially
+// decoded map[string]json.RawMessage, so that the path can descend into it.
+// Other values are returned as is.
+func decodeRaw(obj interface{}) (interface{}, error) {
+	raw, ok := obj.(json.RawMessage)
+	if !ok {
+		return obj, nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// decodeRoot decodes a document passed as raw json, a json.RawMessage or a
+// []byte holding a json object or array, so that it isn't looked up as an
+// array of bytes. Other []byte values are returned as is.
+func decodeRoot(obj interface{}) (interface{}, error) {
+	if b, ok := obj.([]byte); ok {
+		trimmed := bytes.TrimSpace(b)
+		if len(trimmed) == 0 || trimmed[0] != '{' && trimmed[0] != '[' || !json.Valid(trimmed) {
+			return obj, nil
+		}
+		obj = json.RawMessage(trimmed)
+	}
+	return decodeRaw(obj)
+}
+
+// mapKeyString returns the string form of a map key, so that maps with non
+// string keys such as the map[interface{}]interface{} decoded by yaml.v2 can be
+// looked up by key too.
+func mapKeyString(kv reflect.Value) string {
+	if kv.Kind() == reflect.Interface {
+		kv = kv.Elem()
+	}
+	if kv.Kind() == reflect.String {
+		return kv.String()
+	}
+	return fmt.Sprintf("%v", kv.Interface())
+}
+
+// elementsHaveKey reports whether any element of the array arr, other than a
+// nested array, has the given key.
+func elementsHaveKey(arr interface{}, key string) bool {
+	v := reflect.ValueOf(arr)
+	for i := 0; i < v.Len(); i++ {
+		elem := v.Index(i).Interface()
+		if reflect.TypeOf(elem) == nil || reflect.TypeOf(elem).Kind() == reflect.Slice {
+			continue
+		}
+		if _, err := _getByKey(elem, key); err == nil {
+			return true
+		}
+	}
+	return false
 }
 
 func _getByKey(obj interface{}, key string) (interface{}, error) {
+	obj, err := decodeRaw(obj)
+	if err != nil {
+		return nil, err
+	}
 	if reflect.TypeOf(obj) == nil {
 		return nil, ErrGetFromNullObj
 	}
+	if g, ok := obj.(Getter); ok {
+		return getByGetter(g, key)
+	}
 	switch reflect.TypeOf(obj).Kind() {
 	case reflect.Map:
 		// if obj came from stdlib json, its highly likely to be a map[string]interface{}
@@ -769,18 +3510,20 @@ func _getByKey(obj interface{}, key string) (interface{}, error) {
 		if jsonMap, ok := obj.(map[string]interface{}); ok {
 			val, exists := jsonMap[key]
 			if !exists {
-				return nil, fmt.Errorf("no match: %s not found in object", key)
+				return nil, fmt.Errorf("%w: %s not found in object", ErrNotFound, key)
 			}
 			return val, nil
 		}
 		for _, kv := range reflect.ValueOf(obj).MapKeys() {
-			if kv.String() == key {
+			if mapKeyString(kv) == key {
 				return reflect.ValueOf(obj).MapIndex(kv).Interface(), nil
 			}
 		}
-		return nil, fmt.Errorf("no match: %s not found in object", key)
+		return nil, fmt.Errorf("%w: %s not found in object", ErrNotFound, key)
 	case reflect.Slice:
-		// slice we should get from all objects in it.
+		// slice we should get from all objects in it. This flattens exactly
+		// one level: an element that is an array itself yields the array of
+		// its own values of key. See getByKeyFrom for a chain of keys.
 		res := make([]interface{}, 0)
 		for i := 0; i < reflect.ValueOf(obj).Len(); i++ {
 			tmp, _ := getByIdx(obj, i)
@@ -790,10 +3533,131 @@ func _getByKey(obj interface{}, key string) (interface{}, error) {
 		}
 		return res, nil
 	default:
+		// fields of structs, or of pointers to structs, built in Go
+		if fields := structFields(obj); fields != nil {
+			for _, field := range fields {
+				if field.key == key {
+					return field.value, nil
+				}
+			}
+			return nil, fmt.Errorf("%w: %s not found in object", ErrNotFound, key)
+		}
 		return nil, fmt.Errorf("object is not map")
 	}
 }
 
+func (c *Compiled) getByKey(obj interface{}, key string) (interface{}, error) {
+	value, err := getByKey(obj, key)
+	if _, ok := obj.(Getter); ok || err == nil || !c.opts.caseInsensitive || reflect.TypeOf(obj).Kind() != reflect.Map {
+		return value, err
+	}
+	return getByKeyFold(obj, key, err)
+}
+
+// numericKey returns the index of a "key" operation with a numeric key, if
+// NumericKeysAsIndex is enabled.
+func (c *Compiled) numericKey(operation operation) (int, bool) {
+	if !c.opts.numericKeys || operation.op != "key" {
+		return 0, false
+	}
+	idx, err := strconv.Atoi(operation.key)
+	return idx, err == nil
+}
+
+// getByKeyFrom applies key to obj like _getByKey. If spread is set, obj is the
+// array of values returned by a previous key applied to an array, like
+// `friends` of `$.dogs.friends.name`: the key then applies to each of those
+// values, and the matches of the values that are arrays are flattened into the
+// result, like Lookup flattens the matches below each element. It reports
+// whether the result is such an array of values, to be passed as spread with
+// the next key.
+func (c *Compiled) getByKeyFrom(obj interface{}, key string, spread bool) (interface{}, bool, error) {
+	_, numeric := c.numericKey(operation{op: "key", key: key})
+	values, ok := obj.([]interface{})
+	if !spread || numeric || !ok {
+		value, err := c._getByKey(obj, key)
+		if err != nil {
+			return nil, false, err
+		}
+		return value, !numeric && isArrayValue(obj), nil
+	}
+	res := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		v, err := c._getByKey(value, key)
+		if err != nil {
+			continue
+		}
+		if nested, ok := v.([]interface{}); ok && isArrayValue(value) {
+			res = append(res, nested...)
+		} else {
+			res = append(res, v)
+		}
+	}
+	return res, true, nil
+}
+
+// isArrayValue reports whether v is an array, including a json.RawMessage
+// holding one.
+func isArrayValue(v interface{}) bool {
+	if raw, ok := v.(json.RawMessage); ok {
+		trimmed := bytes.TrimSpace(raw)
+		return len(trimmed) > 0 && trimmed[0] == '['
+	}
+	return reflect.TypeOf(v) != nil && reflect.TypeOf(v).Kind() == reflect.Slice
+}
+
+func (c *Compiled) _getByKey(obj interface{}, key string) (interface{}, error) {
+	if reflect.TypeOf(obj) != nil && reflect.TypeOf(obj).Kind() == reflect.Slice {
+		if idx, ok := c.numericKey(operation{op: "key", key: key}); ok {
+			return getByIdx(obj, idx)
+		}
+	}
+	if _, ok := obj.(Getter); ok || !c.opts.caseInsensitive || reflect.TypeOf(obj) == nil {
+		return _getByKey(obj, key)
+	}
+	switch reflect.TypeOf(obj).Kind() {
+	case reflect.Map:
+		value, err := _getByKey(obj, key)
+		if err == nil {
+			return value, nil
+		}
+		return getByKeyFold(obj, key, err)
+	case reflect.Slice:
+		res := make([]interface{}, 0, reflect.ValueOf(obj).Len())
+		for i := 0; i < reflect.ValueOf(obj).Len(); i++ {
+			tmp, _ := getByIdx(obj, i)
+			if v, err := c._getByKey(tmp, key); err == nil {
+				res = append(res, v)
+			}
+		}
+		return res, nil
+	default:
+		return _getByKey(obj, key)
+	}
+}
+
+// getByKeyFold looks up key in a map ignoring case, it's only called after the
+// exact lookup failed with notFound.
+func getByKeyFold(obj interface{}, key string, notFound error) (interface{}, error) {
+	var match reflect.Value
+	matched := make([]string, 0)
+	for _, kv := range reflect.ValueOf(obj).MapKeys() {
+		if k := mapKeyString(kv); strings.EqualFold(k, key) {
+			match = kv
+			matched = append(matched, k)
+		}
+	}
+	switch len(matched) {
+	case 0:
+		return nil, notFound
+	case 1:
+		return reflect.ValueOf(obj).MapIndex(match).Interface(), nil
+	default:
+		sort.Strings(matched)
+		return nil, fmt.Errorf("ambiguous key: %s matches %v", key, matched)
+	}
+}
+
 func setByKey(obj interface{}, key string, value interface{}) error {
 	if reflect.TypeOf(obj) == nil {
 		return ErrGetFromNullObj
@@ -822,19 +3686,123 @@ func setByKey(obj interface{}, key string, value interface{}) error {
 	}
 }
 
+// scriptIndex is a script expression index like `[(@.length-1)]`. Only
+// `@.length`, integer literals and the operators + - * / are supported, with
+// the usual precedence.
+type scriptIndex struct {
+	operands  []string
+	operators []byte
+}
+
+func parseScriptIndex(expr string) (scriptIndex, error) {
+	script := scriptIndex{}
+	operand := ""
+	for i := 0; i < len(expr); i++ {
+		x := expr[i]
+		switch {
+		case x == ' ':
+		case strings.IndexByte("+-*/", x) >= 0 && strings.Trim(operand, " ") != "":
+			script.operands = append(script.operands, operand)
+			script.operators = append(script.operators, x)
+			operand = ""
+		default:
+			operand += string(x)
+		}
+	}
+	script.operands = append(script.operands, operand)
+	for _, o := range script.operands {
+		if o == "@.length" {
+			continue
+		}
+		if _, err := strconv.Atoi(o); err != nil {
+			return scriptIndex{}, fmt.Errorf("invalid script index operand %q in: %s", o, expr)
+		}
+	}
+	return script, nil
+}
+
+func (s scriptIndex) operand(i int, length int) int {
+	if s.operands[i] == "@.length" {
+		return length
+	}
+	v, _ := strconv.Atoi(s.operands[i])
+	return v
+}
+
+// eval computes the index for an array of the given length.
+func (s scriptIndex) eval(length int) (int, error) {
+	sum, term := 0, s.operand(0, length)
+	sign := 1
+	for i, op := range s.operators {
+		v := s.operand(i+1, length)
+		switch op {
+		case '*':
+			term *= v
+		case '/':
+			if v == 0 {
+				return 0, fmt.Errorf("division by zero in script index")
+			}
+			term /= v
+		case '+', '-':
+			sum += sign * term
+			term = v
+			sign = 1
+			if op == '-' {
+				sign = -1
+			}
+		}
+	}
+	return sum + sign*term, nil
+}
+
+// indexArgs returns the indices selected by an "idx" operation on obj,
+// evaluating script indices against the length of obj.
+func indexArgs(obj interface{}, operation operation) ([]int, error) {
+	script, ok := operation.args.(scriptIndex)
+	if !ok {
+		return operation.args.([]int), nil
+	}
+	if reflect.TypeOf(obj) == nil || reflect.TypeOf(obj).Kind() != reflect.Slice {
+		return nil, NotSlice
+	}
+	idx, err := script.eval(reflect.ValueOf(obj).Len())
+	if err != nil {
+		return nil, err
+	}
+	return []int{idx}, nil
+}
+
+// getByIdx returns the element at idx of a slice, counting from the end if idx
+// is negative. An object used as a sparse array, like `{"0": "a", "1": "b"}`, is
+// indexed by its stringified numeric keys instead, so `[1]` resolves to "b";
+// negative indices don't apply to such objects.
 func getByIdx(obj interface{}, idx int) (interface{}, error) {
+	obj, err := decodeRaw(obj)
+	if err != nil {
+		return nil, err
+	}
 	switch reflect.TypeOf(obj).Kind() {
+	case reflect.Map:
+		v := reflect.ValueOf(obj)
+		if v.Type().Key().Kind() != reflect.String || idx < 0 {
+			return nil, NotSlice
+		}
+		item := v.MapIndex(reflect.ValueOf(strconv.Itoa(idx)).Convert(v.Type().Key()))
+		if !item.IsValid() {
+			return nil, fmt.Errorf("%w: %d not found in object", ErrNotFound, idx)
+		}
+		return item.Interface(), nil
 	case reflect.Slice:
 		length := reflect.ValueOf(obj).Len()
 		if idx >= 0 {
 			if idx >= length {
-				return nil, fmt.Errorf("no match: index out of range: len: %v, idx: %v", length, idx)
+				return nil, fmt.Errorf("%w: index out of range: len: %v, idx: %v", ErrNotFound, length, idx)
 			}
 			return reflect.ValueOf(obj).Index(idx).Interface(), nil
 		} else {
 			_idx := length + idx
 			if _idx < 0 {
-				return nil, fmt.Errorf("no match: index out of range: len: %v, idx: %v", length, idx)
+				return nil, fmt.Errorf("%w: index out of range: len: %v, idx: %v", ErrNotFound, length, idx)
 			}
 			return reflect.ValueOf(obj).Index(_idx).Interface(), nil
 		}
@@ -843,6 +3811,38 @@ func getByIdx(obj interface{}, idx int) (interface{}, error) {
 	}
 }
 
+// growAndSet extends the slice stored under key of holder to idx, sets its
+// element at idx to val and writes the grown slice back to holder.
+func growAndSet(holder interface{}, key string, slice interface{}, idx int, val interface{}) error {
+	v := reflect.ValueOf(slice)
+	elem := reflect.Zero(v.Type().Elem())
+	if val != nil {
+		elem = reflect.ValueOf(val)
+		if !elem.Type().AssignableTo(v.Type().Elem()) {
+			return fmt.Errorf("%w: cannot assign %T to %v", ErrTypeMismatch, val, v.Type().Elem())
+		}
+	}
+	grown := reflect.MakeSlice(v.Type(), idx+1, idx+1)
+	reflect.Copy(grown, v)
+	grown.Index(idx).Set(elem)
+
+	if reflect.TypeOf(holder).Kind() == reflect.Map {
+		return setByKey(holder, key, grown.Interface())
+	}
+	for _, field := range structFields(holder) {
+		if field.key != key {
+			continue
+		}
+		target := reflect.ValueOf(holder)
+		if target.Kind() != reflect.Ptr {
+			return fmt.Errorf("cannot set field %s of a struct value", key)
+		}
+		target.Elem().Field(field.field).Set(grown)
+		return nil
+	}
+	return fmt.Errorf("cannot write the grown array back to %T", holder)
+}
+
 func setByIdx(obj interface{}, idx int, val interface{}) error {
 	switch reflect.TypeOf(obj).Kind() {
 	case reflect.Slice:
@@ -867,6 +3867,9 @@ func setByIdx(obj interface{}, idx int, val interface{}) error {
 	}
 }
 
+// getByRange returns the items of obj from frm to to, both inclusive. Negative
+// bounds count from the end, whatever the sign of the other bound, so `[-3:4]`
+// and `[2:-1]` select the same items of a 5-element array.
 func getByRange(obj, frm, to interface{}) (interface{}, error) {
 	switch reflect.TypeOf(obj).Kind() {
 	case reflect.Slice:
@@ -893,11 +3896,19 @@ func getByRange(obj, frm, to interface{}) (interface{}, error) {
 				_to = tv + 1
 			}
 		}
+		if RangeBounds == RangeClamp {
+			_frm = clampIdx(_frm, length)
+			_to = clampIdx(_to, length)
+			if _frm > _to {
+				_frm = _to
+			}
+			return reflect.ValueOf(obj).Slice(_frm, _to).Interface(), nil
+		}
 		if _frm < 0 || _frm >= length {
-			return nil, fmt.Errorf("no match: index [from] out of range: len: %v, from: %v", length, frm)
+			return nil, fmt.Errorf("%w: index [from] out of range: len: %v, from: %v", ErrNotFound, length, frm)
 		}
 		if _to < 0 || _to > length {
-			return nil, fmt.Errorf("no match: index [to] out of range: len: %v, to: %v", length, to)
+			return nil, fmt.Errorf("%w: index [to] out of range: len: %v, to: %v", ErrNotFound, length, to)
 		}
 		arr := reflect.ValueOf(obj).Slice(_frm, _to)
 		return arr.Interface(), nil
@@ -906,6 +3917,121 @@ func getByRange(obj, frm, to interface{}) (interface{}, error) {
 	}
 }
 
+// getByRangeArgs dispatches the args of a "range" operation, which are either
+// [2]interface{}{from, to} or [3]interface{}{from, to, step}.
+func getByRangeArgs(obj interface{}, args interface{}) (interface{}, error) {
+	obj, err := decodeRaw(obj)
+	if err != nil {
+		return nil, err
+	}
+	if fields := structFields(obj); fields != nil && isWildcard(operation{op: "range", args: args}) {
+		values := make([]interface{}, 0, len(fields))
+		for _, field := range fields {
+			values = append(values, field.value)
+		}
+		return values, nil
+	}
+	switch v := args.(type) {
+	case [2]interface{}:
+		return getByRange(obj, v[0], v[1])
+	case [3]interface{}:
+		return getBySteppedRange(obj, v[0], v[1], v[2])
+	default:
+		return nil, fmt.Errorf("range args length should be 2 or 3")
+	}
+}
+
+// rangeExpr formats the args of a "range" operation back into its bracket form.
+func rangeExpr(args interface{}) string {
+	var bounds []interface{}
+	switch v := args.(type) {
+	case [2]interface{}:
+		if v[0] == nil && v[1] == nil {
+			return "*"
+		}
+		bounds = v[:]
+	case [3]interface{}:
+		bounds = v[:]
+	}
+	parts := make([]string, len(bounds))
+	for i, b := range bounds {
+		if b != nil {
+			parts[i] = fmt.Sprintf("%v", b)
+		}
+	}
+	return strings.Join(parts, ":")
+}
+
+// getBySteppedRange handles `[from:to:step]`. Like getByRange both bounds are
+// inclusive; a negative step walks the array backwards, so `[::-1]` reverses it.
+func getBySteppedRange(obj, frm, to, step interface{}) (interface{}, error) {
+	if reflect.TypeOf(obj).Kind() != reflect.Slice {
+		return nil, NotSlice
+	}
+	_step := 1
+	if sv, ok := step.(int); ok == true {
+		_step = sv
+	}
+	if _step > 0 {
+		sliced, err := getByRange(obj, frm, to)
+		if err != nil {
+			return nil, err
+		}
+		v := reflect.ValueOf(sliced)
+		arr := make([]interface{}, 0, v.Len()/_step+1)
+		for i := 0; i < v.Len(); i += _step {
+			arr = append(arr, v.Index(i).Interface())
+		}
+		return arr, nil
+	}
+
+	v := reflect.ValueOf(obj)
+	length := v.Len()
+	arr := make([]interface{}, 0)
+	if length == 0 {
+		return arr, nil
+	}
+	_frm := length - 1
+	_to := 0
+	if fv, ok := frm.(int); ok == true {
+		_frm = fv
+		if fv < 0 {
+			_frm = length + fv
+		}
+	}
+	if tv, ok := to.(int); ok == true {
+		_to = tv
+		if tv < 0 {
+			_to = length + tv
+		}
+	}
+	if RangeBounds == RangeClamp {
+		_frm = clampIdx(_frm, length-1)
+		_to = clampIdx(_to, length-1)
+	} else {
+		if _frm < 0 || _frm >= length {
+			return nil, fmt.Errorf("%w: index [from] out of range: len: %v, from: %v", ErrNotFound, length, frm)
+		}
+		if _to < 0 || _to >= length {
+			return nil, fmt.Errorf("%w: index [to] out of range: len: %v, to: %v", ErrNotFound, length, to)
+		}
+	}
+	for i := _frm; i >= _to; i += _step {
+		arr = append(arr, v.Index(i).Interface())
+	}
+	return arr, nil
+}
+
+func clampIdx(idx, length int) int {
+	if idx < 0 {
+		return 0
+	}
+	if idx > length {
+		return length
+	}
+	return idx
+}
+
 func compileRegexp(rule string) (*regexp.Regexp, error) {
 	runes := []rune(rule)
 	if len(runes) <= 2 {
@@ -920,25 +4046,33 @@ func compileRegexp(rule string) (*regexp.Regexp, error) {
 }
 
 func getFiltered(obj, root interface{}, filter string) ([]interface{}, error) {
+	return getFilteredWith(obj, root, filter, options{})
+}
+
+// getFilteredWith works like getFiltered with the options of a path: with
+// strict an expression failing to evaluate, like an invalid regexp, fails the
+// whole filter instead of not matching.
+func getFilteredWith(obj, root interface{}, filter string, opts options) ([]interface{}, error) {
+	obj, err := decodeRaw(obj)
+	if err != nil {
+		return nil, err
+	}
 	res := make([]interface{}, 0)
-	expressions, err := parseFilter(filter)
-	if err != nil || len(expressions) == 0 {
+	expressions, err := parseFilterWith(filter, opts)
+	if err != nil {
 		return res, err
 	}
+	strict := opts.strict
 
 	switch reflect.TypeOf(obj).Kind() {
 	case reflect.Slice:
 		for i := 0; i < reflect.ValueOf(obj).Len(); i++ {
 			tmp := reflect.ValueOf(obj).Index(i).Interface()
-			match := true
-			for _, expr := range expressions {
-				ok, _ := evalFilter(tmp, root, expr.lp, expr.op, expr.rp)
-				match = match && ok
-				if !match {
-					break
-				}
+			ok, err := evalExpressions(tmp, root, expressions)
+			if err != nil && strict {
+				return nil, err
 			}
-			if match {
+			if ok {
 				res = append(res, tmp)
 			}
 		}
@@ -947,15 +4081,11 @@ func getFiltered(obj, root interface{}, filter string) ([]interface{}, error) {
 	case reflect.Map:
 		for _, kv := range reflect.ValueOf(obj).MapKeys() {
 			tmp := reflect.ValueOf(obj).MapIndex(kv).Interface()
-			match := true
-			for _, expr := range expressions {
-				ok, _ := evalFilter(tmp, root, expr.lp, expr.op, expr.rp)
-				match = match && ok
-				if !match {
-					break
-				}
+			ok, err := evalExpressions(tmp, root, bindKey(expressions, mapKeyString(kv)))
+			if err != nil && strict {
+				return nil, err
 			}
-			if match {
+			if ok {
 				res = append(res, tmp)
 			}
 		}
@@ -966,28 +4096,167 @@ func getFiltered(obj, root interface{}, filter string) ([]interface{}, error) {
 	return res, nil
 }
 
+// getFilteredKeys works like getFiltered on a map, but returns the sorted keys
+// of the matching entries instead of their values.
+func getFilteredKeys(obj, root interface{}, filter string) ([]string, error) {
+	if reflect.TypeOf(obj) == nil || reflect.TypeOf(obj).Kind() != reflect.Map {
+		return nil, NotMap
+	}
+	res := make([]string, 0)
+	expressions, err := parseFilter(filter)
+	if err != nil {
+		return res, err
+	}
+
+	for _, kv := range reflect.ValueOf(obj).MapKeys() {
+		tmp := reflect.ValueOf(obj).MapIndex(kv).Interface()
+		if matchFilter(tmp, root, bindKey(expressions, mapKeyString(kv))) {
+			res = append(res, mapKeyString(kv))
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// filterKey is the `@key` token of filters on maps, e.g. `$.store[?(@key == 'book')]`.
+const filterKey = "@key"
+
+// bindKey replaces `@key` in expressions by the key of the map entry being
+// filtered. The key is compared as a string.
+func bindKey(expressions []*FilterExpression, key string) []*FilterExpression {
+	res := make([]*FilterExpression, len(expressions))
+	for i, expr := range expressions {
+		bound := *expr
+		if bound.lp == filterKey {
+			bound.lp = key
+		}
+		if bound.rp == filterKey {
+			bound.rp, bound.rpQuoted = key, true
+		}
+		res[i] = &bound
+	}
+	return res
+}
+
+// matchFilter reports whether obj matches every expression. An expression
+// failing to evaluate is a mismatch, the error is only surfaced by
+// LookupStrict, through getFilteredWith.
+func matchFilter(obj, root interface{}, expressions []*FilterExpression) bool {
+	ok, _ := evalExpressions(obj, root, expressions)
+	return ok
+}
+
+// evalExpressions reports whether obj matches every expression, stopping at the
+// first one that doesn't match or fails to evaluate.
+func evalExpressions(obj, root interface{}, expressions []*FilterExpression) (bool, error) {
+	for _, expr := range expressions {
+		ok, err := evalExpression(obj, root, expr)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// evalExpression evaluates a parsed filter expression. A quoted literal on the
+// right side of a comparison is compared as a string, so that `@.zip == '01234'`
+// does not match the number 1234.
+func evalExpression(obj, root interface{}, expr *FilterExpression) (bool, error) {
+	switch expr.op {
+	case "<", "<=", "==", "!=", ">=", ">":
+		// `duration(@.timeout) > '100ms'` converts the literal like the field
+		if fn, ok := unitFuncOf(expr.lp); ok && !isPathOperand(expr.rp) && !strings.Contains(expr.rp, "(") {
+			return missingAsFalse(evalOperands(obj, root, expr.lp, expr.op, fn+"('"+expr.rp+"')", false, expr.tolerance))
+		}
+		// `num(@.price) > '10'` still compares numbers, `time(@.ts)` times and
+		// fields with a registered ordering their ranks
+		if !expr.rpQuoted || strings.HasPrefix(expr.lp, "num(") || strings.HasPrefix(expr.lp, "time(") || orderingOf(expr.lp) != nil {
+			break
+		}
+		left, err := getOperand(obj, root, expr.lp)
+		if errors.Is(err, errMissingOperand) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		left = bytesAsString(left)
+		if isContainer(left) {
+			return false, nil
+		}
+		return cmpResult(strings.Compare(fmt.Sprintf("%v", left), expr.rp), expr.op), nil
+	}
+	return missingAsFalse(evalOperands(obj, root, expr.lp, expr.op, expr.rp, expr.rpQuoted, expr.tolerance))
+}
+
 type FilterExpression struct {
 	lp string
 	op string
 	rp string
+	// rpQuoted is set when rp was a quoted literal like '01234'
+	rpQuoted bool
+	// tolerance is the FloatTolerance of the path the filter belongs to
+	tolerance float64
+}
+
+// parseFilterWith parses filter like parseFilter, and applies the options of
+// the path it belongs to to its expressions.
+func parseFilterWith(filter string, opts options) ([]*FilterExpression, error) {
+	expressions, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, expr := range expressions {
+		expr.tolerance = opts.floatTolerance
+	}
+	return expressions, nil
 }
 
 // @.isbn                 => @.isbn, exists, nil
 // @.price < 10           => @.price, <, 10
 // @.price <= $.expensive => @.price, <=, $.expensive
 // @.author =~ /.*REES/i  => @.author, match, /.*REES/i
+// @.price between 8 and 13 => @.price, between, 8 and 13
+// @.price within $.range  => @.price, within, $.range
+// @.title ^= 'The'       => @.title, ^=, The
+//
+// An empty filter has no expressions and matches everything.
 func parseFilter(filter string) (expressions []*FilterExpression, err error) {
-	subs := strings.Split(filter, "&&")
+	if strings.TrimSpace(filter) == "" {
+		return []*FilterExpression{}, nil
+	}
+	subs := splitFilter(filter)
 	expressions = make([]*FilterExpression, 0, len(subs))
 	for _, sub := range subs {
 		sub = strings.TrimSpace(sub)
 		tmp, lp, op, rp := "", "", "", ""
+		rpQuoted := false
 
 		stage := 0
 		strEmbrace := false
+		depth := 0
+		// position of the first space splitting the right side, which is only
+		// valid in arithmetic like `$.budget * 0.5`
+		rpSpace := -1
 		for idx, c := range sub {
+			// nested filters like `@.books[?(@.price < 5)]` are kept as is
+			if c == '[' {
+				depth++
+			} else if c == ']' && depth > 0 {
+				depth--
+				tmp += string(c)
+				continue
+			}
+			if depth > 0 {
+				tmp += string(c)
+				continue
+			}
 			switch c {
 			case '\'':
+				// quoted arguments of functions like `time('2023-01-01')` are kept
+				if !strEmbrace && inCall(tmp) {
+					tmp += string(c)
+					continue
+				}
 				if strEmbrace == false {
 					strEmbrace = true
 				} else {
@@ -998,11 +4267,19 @@ func parseFilter(filter string) (expressions []*FilterExpression, err error) {
 						op = tmp
 					case 2:
 						rp = tmp
+						rpQuoted = true
 					}
 					tmp = ""
 				}
 			case ' ':
-				if strEmbrace == true {
+				if strEmbrace == true || inCall(tmp) {
+					tmp += string(c)
+					continue
+				}
+				if stage == 2 {
+					if rpSpace < 0 {
+						rpSpace = idx
+					}
 					tmp += string(c)
 					continue
 				}
@@ -1037,107 +4314,756 @@ func parseFilter(filter string) (expressions []*FilterExpression, err error) {
 			}
 			tmp = ""
 		}
+		if rpSpace >= 0 && op != "between" {
+			if _, _, ok := splitArithmetic(strings.TrimSpace(rp)); !ok {
+				err = errors.New(fmt.Sprintf("invalid char at %d: ` `", rpSpace))
+				return
+			}
+		}
+
+		expr := &FilterExpression{
+			lp:       lp,
+			op:       op,
+			rp:       rp,
+			rpQuoted: rpQuoted,
+		}
+		expressions = append(expressions, expr)
+	}
+
+	return
+}
+
+// inCall reports whether tmp ends inside the parentheses of a function call
+// like `time(`. Parentheses inside quoted arguments are not counted.
+func inCall(tmp string) bool {
+	depth, quoted := 0, false
+	for i := 0; i < len(tmp); i++ {
+		switch c := tmp[i]; {
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case c == '(' && i > 0 && isIdentChar(tmp[i-1]):
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		}
+	}
+	return depth > 0
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// splitFilter splits a filter on the `&&` that are not part of a nested filter.
+func splitFilter(filter string) []string {
+	subs := make([]string, 0)
+	depth, start := 0, 0
+	for i := 0; i < len(filter); i++ {
+		switch filter[i] {
+		case '[':
+			depth++
+		case ']':
+			if depth > 0 {
+				depth--
+			}
+		case '&':
+			if depth == 0 && strings.HasPrefix(filter[i:], "&&") {
+				subs = append(subs, filter[start:i])
+				start = i + 2
+				i++
+			}
+		}
+	}
+	return append(subs, filter[start:])
+}
+
+func parse_filter_v1(filter string) (lp string, op string, rp string, err error) {
+	tmp := ""
+	istoken := false
+	for _, c := range filter {
+		if istoken == false && c != ' ' {
+			istoken = true
+		}
+		if istoken == true && c == ' ' {
+			istoken = false
+		}
+		if istoken == true {
+			tmp += string(c)
+		}
+		if istoken == false && tmp != "" {
+			if lp == "" {
+				lp = tmp[:]
+				tmp = ""
+			} else if op == "" {
+				op = tmp[:]
+				tmp = ""
+			} else if rp == "" {
+				rp = tmp[:]
+				tmp = ""
+			}
+		}
+	}
+	if tmp != "" && lp == "" && op == "" && rp == "" {
+		lp = tmp[:]
+		op = "exists"
+		rp = ""
+		err = nil
+		return
+	} else if tmp != "" && rp == "" {
+		rp = tmp[:]
+		tmp = ""
+	}
+	return lp, op, rp, err
+}
+
+// documentRegexp compiles a pattern found in the document, either `/pattern/`
+// or a bare pattern.
+func documentRegexp(pattern interface{}) (*regexp.Regexp, error) {
+	str, ok := pattern.(string)
+	if !ok {
+		return nil, fmt.Errorf("regular expression should be a string: %v", pattern)
+	}
+	if reg, err := compileRegexp(str); err == nil {
+		return reg, nil
+	}
+	return regexp.Compile(str)
+}
+
+func evalRegexp(obj, root interface{}, lp string, pat *regexp.Regexp) (res bool, err error) {
+	if pat == nil {
+		return false, errors.New("nil pat")
+	}
+	lp_v, err := getByPath(obj, root, lp)
+	if err != nil {
+		return false, err
+	}
+	switch v := bytesAsString(lp_v).(type) {
+	case string:
+		return pat.MatchString(v), nil
+	case coercedString:
+		return pat.MatchString(string(v)), nil
+	default:
+		return false, errors.New("only string can match with regular expression")
+	}
+}
+
+// isPathOperand reports whether an operand of a filter is a path like `@.price`,
+// `$.expensive` or `@['content-type']` rather than a literal.
+func isPathOperand(operand string) bool {
+	for _, prefix := range []string{"@.", "$.", "@['", "$['", "@?.", "$?."} {
+		if strings.HasPrefix(operand, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripOptionalChaining turns the `?.` of optional chaining like `@?.a?.b` into
+// plain `.`, leaving quoted keys and nested filters alone.
+func stripOptionalChaining(path string) string {
+	if !strings.Contains(path, "?.") {
+		return path
+	}
+	var b strings.Builder
+	depth, quoted := 0, false
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '\\' && i+1 < len(path):
+			b.WriteByte(c)
+			i++
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case c == '[':
+			depth++
+		case c == ']' && depth > 0:
+			depth--
+		case c == '?' && depth == 0 && strings.HasPrefix(path[i:], "?."):
+			continue
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+func getByPath(obj, root interface{}, path string) (interface{}, error) {
+	if operands, operators, ok := splitArithmetic(path); ok {
+		return evalArithmetic(obj, root, operands, operators)
+	}
+	if strings.HasPrefix(path, "json(") || strings.HasPrefix(path, "parse(") {
+		return getByJSONPath(obj, root, path)
+	}
+	if (strings.HasPrefix(path, "num(") || strings.HasPrefix(path, "str(")) && strings.HasSuffix(path, ")") {
+		return getByCoercion(obj, root, path)
+	}
+	if strings.HasPrefix(path, "time(") && strings.HasSuffix(path, ")") {
+		return getByTime(obj, root, path)
+	}
+	if fn, ok := stringFuncOf(path); ok {
+		return getByStringFunc(obj, root, path, fn)
+	}
+	if fn, ok := unitFuncOf(path); ok {
+		return getByUnit(obj, root, path, fn)
+	}
+	if strings.HasPrefix(path, "coalesce(") && strings.HasSuffix(path, ")") {
+		return getByCoalesce(obj, root, path)
+	}
+	if path == filterKey {
+		return nil, fmt.Errorf("%s is only available in filters on objects", filterKey)
+	}
+	var v interface{}
+	if isPathOperand(path) && path[0] == '@' {
+		return derefPath(filterGetFromPath(obj, root, path))
+	} else if isPathOperand(path) {
+		return derefPath(filterGetFromPath(root, root, path))
+	} else {
+		v = path
+	}
+	return v, nil
+}
+
+// coercedString is the result of `str()`. It always compares as a string, even
+// if its content or the other operand looks like a number.
+type coercedString string
+
+// getByCoercion resolves `num(@.price)` to the value of the inner path as a
+// float64, parsing numeric strings, and `str(@.id)` to its value as a string.
+func getByCoercion(obj, root interface{}, path string) (interface{}, error) {
+	inner := path[len("num(") : len(path)-1]
+	value, err := getByPath(obj, root, inner)
+	if err != nil {
+		return nil, err
+	}
+	value = bytesAsString(value)
+	if value == nil {
+		return nil, fmt.Errorf("%s is null", inner)
+	}
+	if isContainer(value) {
+		return nil, fmt.Errorf("%w: %s is not a scalar: %v", ErrTypeMismatch, inner, value)
+	}
+	if strings.HasPrefix(path, "str(") {
+		return coercedString(fmt.Sprintf("%v", value)), nil
+	}
+	if _, ok := value.(bool); ok || !isNumber(value) {
+		return nil, fmt.Errorf("%s is not a number: %v", inner, value)
+	}
+	return toFloat64(value)
+}
+
+// stringFuncs are the filter functions transforming a string, like
+// `trim(@.author) == 'Nigel Rees'`.
+var stringFuncs = map[string]func(string) string{
+	"trim":  strings.TrimSpace,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// stringFuncOf returns the name of the string function path is a call of.
+func stringFuncOf(path string) (string, bool) {
+	i := strings.IndexByte(path, '(')
+	if i < 0 || !strings.HasSuffix(path, ")") {
+		return "", false
+	}
+	_, ok := stringFuncs[path[:i]]
+	return path[:i], ok
+}
+
+// getByStringFunc resolves a call of a string function like `lower(@.title)`.
+// The argument may be a path, another call like `lower(trim(@.title))`, or a
+// quoted literal.
+func getByStringFunc(obj, root interface{}, path, fn string) (interface{}, error) {
+	inner := path[len(fn)+1 : len(path)-1]
+	if len(inner) >= 2 && inner[0] == '\'' && inner[len(inner)-1] == '\'' {
+		return stringFuncs[fn](inner[1 : len(inner)-1]), nil
+	}
+	value, err := getByPath(obj, root, inner)
+	if err != nil {
+		return nil, err
+	}
+	switch v := bytesAsString(value).(type) {
+	case string:
+		return stringFuncs[fn](v), nil
+	case coercedString:
+		return coercedString(stringFuncs[fn](string(v))), nil
+	case nil:
+		return nil, fmt.Errorf("%s is null", inner)
+	default:
+		return nil, fmt.Errorf("%w: %s is not a string: %v", ErrTypeMismatch, inner, value)
+	}
+}
+
+// getByCoalesce resolves `coalesce(@.discount, @.rebate, 0)` to its first
+// argument that is neither missing nor null. Arguments may be paths, calls of
+// other functions, quoted strings or literals like numbers; `null` is null. If
+// every argument is missing or null, the result is missing too.
+func getByCoalesce(obj, root interface{}, path string) (interface{}, error) {
+	for _, arg := range splitArgs(path[len("coalesce(") : len(path)-1]) {
+		if len(arg) >= 2 && arg[0] == '\'' && arg[len(arg)-1] == '\'' {
+			return arg[1 : len(arg)-1], nil
+		}
+		if arg == "null" || arg == "" {
+			continue
+		}
+		value, err := getByPath(obj, root, arg)
+		if errors.Is(err, ErrInvalidPath) {
+			return nil, err
+		}
+		if err == nil && value != nil {
+			return value, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: every argument of %s is missing or null", ErrNotFound, path)
+}
 
-		expr := &FilterExpression{
-			lp: lp,
-			op: op,
-			rp: rp,
+// splitArgs splits the arguments of a function call on the commas that are not
+// part of a nested call, bracket or quoted string.
+func splitArgs(args string) []string {
+	var res []string
+	depth, start, quoted := 0, 0, false
+	for i := 0; i < len(args); i++ {
+		switch c := args[i]; {
+		case c == '\\':
+			i++
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case c == '(' || c == '[':
+			depth++
+		case (c == ')' || c == ']') && depth > 0:
+			depth--
+		case c == ',' && depth == 0:
+			res = append(res, strings.TrimSpace(args[start:i]))
+			start = i + 1
 		}
-		expressions = append(expressions, expr)
 	}
+	return append(res, strings.TrimSpace(args[start:]))
+}
 
-	return
+// unitFuncs are the filter functions parsing numbers with a unit suffix into
+// comparable float64 values:
+//   - `duration()` takes the units of time.ParseDuration, like "500ms" or
+//     "1h30m", and yields seconds
+//   - `bytes()` takes B, the decimal KB, MB, GB, TB and PB, and the binary
+//     KiB, MiB, GiB, TiB and PiB, case insensitive, like "2MB" or "1.5 GiB",
+//     and yields bytes
+//
+// Plain numbers are taken as seconds and bytes respectively.
+var unitFuncs = map[string]func(string) (float64, error){
+	"duration": parseDurationSeconds,
+	"bytes":    parseByteSize,
 }
 
-func parse_filter_v1(filter string) (lp string, op string, rp string, err error) {
-	tmp := ""
-	istoken := false
-	for _, c := range filter {
-		if istoken == false && c != ' ' {
-			istoken = true
+// unitFuncOf returns the name of the unit function path is a call of.
+func unitFuncOf(path string) (string, bool) {
+	i := strings.IndexByte(path, '(')
+	if i < 0 || !strings.HasSuffix(path, ")") {
+		return "", false
+	}
+	_, ok := unitFuncs[path[:i]]
+	return path[:i], ok
+}
+
+// getByUnit resolves a call of a unit function like `bytes(@.size)` or
+// `duration('100ms')` to a float64.
+func getByUnit(obj, root interface{}, path, fn string) (interface{}, error) {
+	inner := path[len(fn)+1 : len(path)-1]
+	var value interface{} = inner
+	if len(inner) >= 2 && inner[0] == '\'' && inner[len(inner)-1] == '\'' {
+		value = inner[1 : len(inner)-1]
+	} else {
+		var err error
+		if value, err = getByPath(obj, root, inner); err != nil {
+			return nil, err
 		}
-		if istoken == true && c == ' ' {
-			istoken = false
+	}
+	switch v := bytesAsString(value).(type) {
+	case nil:
+		return nil, fmt.Errorf("%s is null", inner)
+	case string:
+		n, err := unitFuncs[fn](strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrTypeMismatch, err)
 		}
-		if istoken == true {
-			tmp += string(c)
+		return n, nil
+	default:
+		if _, ok := v.(bool); ok || !isNumber(v) {
+			return nil, fmt.Errorf("%w: %s is not a %s: %v", ErrTypeMismatch, inner, fn, value)
 		}
-		if istoken == false && tmp != "" {
-			if lp == "" {
-				lp = tmp[:]
-				tmp = ""
-			} else if op == "" {
-				op = tmp[:]
-				tmp = ""
-			} else if rp == "" {
-				rp = tmp[:]
-				tmp = ""
+		return toFloat64(v)
+	}
+}
+
+func parseDurationSeconds(s string) (float64, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return d.Seconds(), nil
+}
+
+var byteUnits = map[string]float64{
+	"b":  1,
+	"kb": 1e3, "mb": 1e6, "gb": 1e9, "tb": 1e12, "pb": 1e15,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40, "pib": 1 << 50,
+}
+
+func parseByteSize(s string) (float64, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.' && r != '-' && r != '+'
+	})
+	if i < 0 {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+	unit, ok := byteUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit of byte size %q", s)
+	}
+	return n * unit, nil
+}
+
+// timeLayouts are the layouts accepted by `time()` for strings.
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"}
+
+// getByTime resolves `time(@.ts)` or `time('2023-01-01')` to a time.Time. The
+// value may be a number of seconds since the epoch or an RFC3339 string, so
+// that timestamps stored in either form compare with each other.
+func getByTime(obj, root interface{}, path string) (interface{}, error) {
+	inner := path[len("time(") : len(path)-1]
+	if len(inner) >= 2 && inner[0] == '\'' && inner[len(inner)-1] == '\'' {
+		return toTime(inner[1 : len(inner)-1])
+	}
+	value, err := getByPath(obj, root, inner)
+	if err != nil {
+		return nil, err
+	}
+	return toTime(value)
+}
+
+func toTime(o interface{}) (time.Time, error) {
+	switch v := bytesAsString(o).(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, nil
 			}
 		}
 	}
-	if tmp != "" && lp == "" && op == "" && rp == "" {
-		lp = tmp[:]
-		op = "exists"
-		rp = ""
-		err = nil
-		return
-	} else if tmp != "" && rp == "" {
-		rp = tmp[:]
-		tmp = ""
+	if _, ok := o.(bool); !ok && isNumber(o) {
+		if f, err := toFloat64(o); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			sec, frac := math.Modf(f)
+			return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+		}
 	}
-	return lp, op, rp, err
+	return time.Time{}, fmt.Errorf("not a time: %v", o)
 }
 
-func evalRegexp(obj, root interface{}, lp string, pat *regexp.Regexp) (res bool, err error) {
-	if pat == nil {
-		return false, errors.New("nil pat")
+// derefPath returns the value a path resolved to, dereferencing pointers like
+// the *int fields of data built in Go. A nil pointer is reported as not found.
+func derefPath(o interface{}, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
 	}
-	lp_v, err := getByPath(obj, root, lp)
+	v := reflect.ValueOf(o)
+	if v.Kind() != reflect.Ptr {
+		return o, nil
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, fmt.Errorf("%w: nil pointer", ErrNotFound)
+		}
+		v = v.Elem()
+	}
+	return v.Interface(), nil
+}
+
+// getByJSONPath resolves `json(@.payload).id`: the string value of the inner
+// path is decoded as json and the rest of the path is applied to the result.
+// `parse()` is an alias of `json()`.
+func getByJSONPath(obj, root interface{}, path string) (interface{}, error) {
+	open := strings.Index(path, "(")
+	end := strings.Index(path, ")")
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated %s: %s", path[:open+1], path)
+	}
+	inner, rest := path[open+1:end], path[end+1:]
+	value, err := getByPath(obj, root, inner)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	switch v := lp_v.(type) {
-	case string:
-		return pat.MatchString(v), nil
-	default:
-		return false, errors.New("only string can match with regular expression")
+	text, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not a string: %v", ErrTypeMismatch, inner, value)
+	}
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(text), &decoded); err != nil {
+		return nil, err
 	}
+	if rest == "" {
+		return decoded, nil
+	}
+	return filterGetFromPath(decoded, root, "@"+rest)
 }
 
-func getByPath(obj, root interface{}, path string) (interface{}, error) {
-	var v interface{}
-	if strings.HasPrefix(path, "@.") {
-		return filterGetFromExplicitPath(obj, path)
-	} else if strings.HasPrefix(path, "$.") {
-		return filterGetFromExplicitPath(root, path)
-	} else {
-		v = path
+// splitArithmetic splits an arithmetic expression like `$.base + $.tax * 2`
+// into its operands and operators. Operators must be surrounded by spaces, as
+// `-` is valid in keys. Operands are paths or number literals.
+func splitArithmetic(expr string) (operands []string, operators []string, ok bool) {
+	// most operands are a single path or literal, skip splitting them
+	if !strings.Contains(expr, " ") {
+		return nil, nil, false
 	}
-	return v, nil
+	fields := strings.Fields(expr)
+	if len(fields) < 3 || len(fields)%2 == 0 {
+		return nil, nil, false
+	}
+	for i, field := range fields {
+		if i%2 == 1 {
+			if field != "+" && field != "-" && field != "*" && field != "/" {
+				return nil, nil, false
+			}
+			operators = append(operators, field)
+			continue
+		}
+		if !isPathOperand(field) {
+			if _, err := strconv.ParseFloat(field, 64); err != nil {
+				return nil, nil, false
+			}
+		}
+		operands = append(operands, field)
+	}
+	return operands, operators, true
+}
+
+// evalArithmetic computes the value of an expression split by splitArithmetic,
+// with * and / taking precedence over + and -.
+func evalArithmetic(obj, root interface{}, operands []string, operators []string) (float64, error) {
+	values := make([]float64, len(operands))
+	for i, operand := range operands {
+		v, err := getByPath(obj, root, operand)
+		if err != nil {
+			return 0, err
+		}
+		if !isNumber(v) {
+			return 0, fmt.Errorf("%w: %s is not a number: %v", ErrTypeMismatch, operand, v)
+		}
+		if values[i], err = toFloat64(v); err != nil {
+			return 0, err
+		}
+	}
+	sum, term, sign := 0.0, values[0], 1.0
+	for i, op := range operators {
+		v := values[i+1]
+		switch op {
+		case "*":
+			term *= v
+		case "/":
+			if v == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			term /= v
+		case "+", "-":
+			sum += sign * term
+			term, sign = v, 1
+			if op == "-" {
+				sign = -1
+			}
+		}
+	}
+	return sum + sign*term, nil
 }
 
+// evalFilter evaluates `lp op rp` against obj. An operand path that doesn't
+// exist, like `@.sale` on an object without a sale, makes the expression a
+// non-match rather than an error, the same as a missing key in the path.
 func evalFilter(obj, root interface{}, lp, op, rp string) (bool, error) {
-	left, err := getByPath(obj, root, lp)
+	return missingAsFalse(evalOperands(obj, root, lp, op, rp, false, 0))
+}
+
+func missingAsFalse(ok bool, err error) (bool, error) {
+	if errors.Is(err, errMissingOperand) {
+		return false, nil
+	}
+	return ok, err
+}
+
+var errMissingOperand = errors.New("missing operand")
+
+// getOperand works like getByPath, but reports a path that cannot be resolved
+// in the data as errMissingOperand.
+func getOperand(obj, root interface{}, path string) (interface{}, error) {
+	v, err := getByPath(obj, root, path)
+	if err != nil && !errors.Is(err, ErrInvalidPath) && !errors.Is(err, ErrTypeMismatch) {
+		return nil, fmt.Errorf("%w: %v", errMissingOperand, err)
+	}
+	return v, err
+}
+
+// evalOperands evaluates `lp op rp`. A quoted rp is taken as is, so that
+// `@.title contains '1 - 2'` looks for the text rather than a difference.
+// Numbers are equal if they differ by at most tolerance.
+func evalOperands(obj, root interface{}, lp, op, rp string, rpQuoted bool, tolerance float64) (bool, error) {
+	left, err := getOperand(obj, root, lp)
 	if err != nil {
 		return false, err
 	}
+	right := func() (interface{}, error) {
+		if rpQuoted {
+			return rp, nil
+		}
+		return getOperand(obj, root, rp)
+	}
 
 	switch op {
 	case "exists":
 		return left != nil, nil
 	case "=~":
-		reg, err := compileRegexp(rp)
+		var reg *regexp.Regexp
+		if !rpQuoted && isPathOperand(rp) {
+			// pattern provided by the document itself, `/pattern/` or a bare `pattern`
+			right, err := right()
+			if err != nil {
+				return false, err
+			}
+			// an array of patterns like `$.patterns` matches if any of them
+			// does, patterns are tried in order until the first match
+			if v := reflect.ValueOf(right); right != nil && v.Kind() == reflect.Slice {
+				for i := 0; i < v.Len(); i++ {
+					if reg, err = documentRegexp(v.Index(i).Interface()); err != nil {
+						return false, err
+					}
+					if ok, err := evalRegexp(obj, root, lp, reg); ok || err != nil {
+						return ok, err
+					}
+				}
+				return false, nil
+			}
+			if reg, err = documentRegexp(right); err != nil {
+				return false, err
+			}
+		} else {
+			if reg, err = compileRegexp(rp); err != nil {
+				return false, err
+			}
+		}
+		return evalRegexp(obj, root, lp, reg)
+	case "contains":
+		right, err := right()
 		if err != nil {
 			return false, err
 		}
-		return evalRegexp(obj, root, lp, reg)
+		return contains(left, right, tolerance)
+	case "between":
+		bounds := strings.Split(rp, " and ")
+		if len(bounds) != 2 {
+			return false, fmt.Errorf("between should be used as `between <low> and <high>`: %s", rp)
+		}
+		for i, cmp := range []string{">=", "<="} {
+			bound, err := getOperand(obj, root, strings.TrimSpace(bounds[i]))
+			if err != nil {
+				return false, err
+			}
+			if isContainer(bound) {
+				return false, ErrTypeMismatch
+			}
+			if ok, err := compareWithin(left, bound, cmp, tolerance); !ok || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	case "within":
+		// `within` takes an inclusive [min, max] span, unlike `in` which takes
+		// a set of discrete values
+		span, err := right()
+		if err != nil {
+			return false, err
+		}
+		v := reflect.ValueOf(span)
+		if span == nil || v.Kind() != reflect.Slice || v.Len() != 2 {
+			return false, fmt.Errorf("%w: within should be used with a [min, max] array: %v", ErrTypeMismatch, span)
+		}
+		for i, cmp := range []string{">=", "<="} {
+			bound := v.Index(i).Interface()
+			if !isNumber(bound) {
+				return false, fmt.Errorf("%w: bounds of within should be numbers: %v", ErrTypeMismatch, span)
+			}
+			if ok, err := compareWithin(left, bound, cmp, tolerance); !ok || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	case "^=", "$=":
+		right, err := right()
+		if err != nil {
+			return false, err
+		}
+		str, ok1 := bytesAsString(left).(string)
+		affix, ok2 := bytesAsString(right).(string)
+		if !ok1 || !ok2 {
+			return false, nil
+		}
+		if op == "^=" {
+			return strings.HasPrefix(str, affix), nil
+		}
+		return strings.HasSuffix(str, affix), nil
+	case "in":
+		right, err := right()
+		if err != nil {
+			return false, err
+		}
+		if !isContainer(right) {
+			return false, ErrTypeMismatch
+		}
+		return contains(right, left, tolerance)
 	default:
-		right, err := getByPath(obj, root, rp)
+		right, err := right()
 		if err != nil {
 			return false, err
 		}
+		right = bytesAsString(right)
+		// an array or object on the right side has no defined ordering
+		if isContainer(right) {
+			return false, ErrTypeMismatch
+		}
+		if order := orderingOf(lp); order != nil {
+			return compareRanked(left, right, op, order)
+		}
+
+		return compareWithin(left, right, op, tolerance)
+	}
+}
 
-		return compare(left, right, op)
+// contains reports whether container holds item. An array contains an element
+// equal to item within tolerance, a string contains item as a substring.
+func contains(container, item interface{}, tolerance float64) (bool, error) {
+	if container == nil {
+		return false, nil
+	}
+	switch reflect.TypeOf(container).Kind() {
+	case reflect.Slice, reflect.Array:
+		v := reflect.ValueOf(container)
+		for i := 0; i < v.Len(); i++ {
+			if ok, _ := compareWithin(v.Index(i).Interface(), item, "==", tolerance); ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	case reflect.String:
+		return strings.Contains(reflect.ValueOf(container).String(), fmt.Sprintf("%v", item)), nil
+	default:
+		return false, nil
 	}
 }
 
@@ -1149,6 +5075,9 @@ func isNumber(o interface{}) bool {
 		return true
 	case float32, float64:
 		return true
+	case json.Number:
+		_, err := strconv.ParseFloat(string(v), 64)
+		return err == nil
 	case string:
 		_, err := strconv.ParseFloat(v, 64)
 		if err == nil {
@@ -1160,33 +5089,240 @@ func isNumber(o interface{}) bool {
 	return false
 }
 
+func toFloat64(o interface{}) (float64, error) {
+	v := reflect.ValueOf(o)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return strconv.ParseFloat(v.String(), 64)
+	}
+	return 0, fmt.Errorf("not a number: %v", o)
+}
+
+// bytesAsString turns a []byte into a string, so that string-like values built
+// in Go compare and match like strings.
+func bytesAsString(o interface{}) interface{} {
+	if b, ok := o.([]byte); ok {
+		return string(b)
+	}
+	return o
+}
+
+func isContainer(o interface{}) bool {
+	if o == nil {
+		return false
+	}
+	switch reflect.TypeOf(o).Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return true
+	}
+	return false
+}
+
+var (
+	orderingsMu sync.RWMutex
+	orderings   = map[string]map[string]int{}
+)
+
+// RegisterOrdering makes filters compare the string values of field by their
+// position in order instead of lexically, so that with the order
+// `pending, active, done`, `@.status > 'pending'` matches "active" and "done".
+// field is the last key of the compared path, e.g. `status` for both
+// `@.status` and `@.task.status`. Values missing from order match no
+// comparison. Registering a nil order removes the ordering of field.
+func RegisterOrdering(field string, order []string) {
+	orderingsMu.Lock()
+	defer orderingsMu.Unlock()
+	if order == nil {
+		delete(orderings, field)
+		return
+	}
+	ranks := make(map[string]int, len(order))
+	for i, value := range order {
+		ranks[value] = i
+	}
+	orderings[field] = ranks
+}
+
+// orderingOf returns the ranks registered with RegisterOrdering for the last
+// key of the operand path, or nil.
+func orderingOf(operand string) map[string]int {
+	orderingsMu.RLock()
+	defer orderingsMu.RUnlock()
+	if len(orderings) == 0 || !isPathOperand(operand) {
+		return nil
+	}
+	steps, err := parse(operand)
+	if err != nil || len(steps) < 2 {
+		return nil
+	}
+	last := steps[len(steps)-1]
+	if _, quoted, ok := quotedKey(last); ok {
+		return orderings[quoted]
+	}
+	if op, key, _, err := parseFragment(last); err == nil && op == "key" {
+		return orderings[key]
+	}
+	return nil
+}
+
+// compareRanked compares two values of a field with a registered ordering by
+// their ranks.
+func compareRanked(obj1, obj2 interface{}, op string, ranks map[string]int) (bool, error) {
+	s1, ok1 := bytesAsString(obj1).(string)
+	s2, ok2 := bytesAsString(obj2).(string)
+	if !ok1 || !ok2 {
+		return false, nil
+	}
+	r1, ok1 := ranks[s1]
+	r2, ok2 := ranks[s2]
+	if !ok1 || !ok2 {
+		return false, nil
+	}
+	return compare(r1, r2, op)
+}
+
 func compare(obj1, obj2 interface{}, op string) (bool, error) {
+	return compareWithin(obj1, obj2, op, 0)
+}
+
+// compareWithin works like compare, but two numbers differing by at most
+// tolerance are equal for `==` and `!=`.
+func compareWithin(obj1, obj2 interface{}, op string, tolerance float64) (bool, error) {
 	switch op {
-	case "<", "<=", "==", ">=", ">":
+	case "<", "<=", "==", "!=", ">=", ">":
 	default:
-		return false, fmt.Errorf("op should only be <, <=, ==, >= and >")
+		return false, fmt.Errorf("op should only be <, <=, ==, !=, >= and >")
+	}
+	obj1, obj2 = bytesAsString(obj1), bytesAsString(obj2)
+
+	// objects and arrays have no ordering, treat them as a mismatch. A filter
+	// over the members of an object meets them as soon as one member is an
+	// array, like `book` in `$.store[?(@.price > 15)]`, and failing there would
+	// fail the whole filter instead of skipping that member.
+	if isContainer(obj1) || isContainer(obj2) {
+		return false, nil
+	}
+
+	// a time compares with anything `time()` accepts, like '2023-01-01'
+	t1, time1 := obj1.(time.Time)
+	t2, time2 := obj2.(time.Time)
+	if time1 || time2 {
+		var err1, err2 error
+		if !time1 {
+			t1, err1 = toTime(obj1)
+		}
+		if !time2 {
+			t2, err2 = toTime(obj2)
+		}
+		if err1 != nil || err2 != nil {
+			return false, nil
+		}
+		c := 0
+		if t1.Before(t2) {
+			c = -1
+		} else if t1.After(t2) {
+			c = 1
+		}
+		return cmpResult(c, op), nil
+	}
+
+	_, str1 := obj1.(coercedString)
+	_, str2 := obj2.(coercedString)
+	if str1 || str2 {
+		return cmpResult(strings.Compare(fmt.Sprintf("%v", obj1), fmt.Sprintf("%v", obj2)), op), nil
+	}
+
+	// a bool has no numeric value, `@.active > 0` must not compare "true" and
+	// "0" as strings: it matches nothing, not even with !=
+	_, bool1 := obj1.(bool)
+	_, bool2 := obj2.(bool)
+	if bool1 && isNumber(obj2) || bool2 && isNumber(obj1) {
+		return false, nil
 	}
 
-	var exp string
 	if isNumber(obj1) && isNumber(obj2) {
-		exp = fmt.Sprintf(`%v %s %v`, obj1, op, obj2)
-	} else {
-		exp = fmt.Sprintf(`"%v" %s "%v"`, obj1, op, obj2)
+		f1, _ := toFloat64(obj1)
+		f2, _ := toFloat64(obj2)
+		// NaN is unordered and unequal to everything, like in IEEE 754
+		if math.IsNaN(f1) || math.IsNaN(f2) {
+			return op == "!=", nil
+		}
+		if tolerance > 0 && (op == "==" || op == "!=") {
+			equal := f1 == f2 || math.Abs(f1-f2) <= tolerance
+			return equal == (op == "=="), nil
+		}
 	}
-	//fmt.Println("exp: ", exp)
-	fset := token.NewFileSet()
-	res, err := types.Eval(fset, nil, 0, exp)
-	if err != nil {
-		return false, err
+
+	if isNumber(obj1) && isNumber(obj2) {
+		n1, err := toBigFloat(obj1)
+		if err != nil {
+			return false, err
+		}
+		n2, err := toBigFloat(obj2)
+		if err != nil {
+			return false, err
+		}
+		return cmpResult(n1.Cmp(n2), op), nil
 	}
-	if res.IsValue() == false || (res.Value.String() != "false" && res.Value.String() != "true") {
-		return false, fmt.Errorf("result should only be true or false")
+
+	return cmpResult(strings.Compare(fmt.Sprintf("%v", obj1), fmt.Sprintf("%v", obj2)), op), nil
+}
+
+// toBigFloat converts a number, or a numeric string, to a big.Float holding its
+// exact value, so that ints, uints and floats of any size compare correctly
+// with each other.
+func toBigFloat(o interface{}) (*big.Float, error) {
+	v := reflect.ValueOf(o)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return new(big.Float).SetInt64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return new(big.Float).SetUint64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return floatToBig(v.Float())
+	case reflect.String:
+		if f, ok := new(big.Float).SetPrec(256).SetString(v.String()); ok {
+			return f, nil
+		}
+		f, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			return nil, err
+		}
+		return floatToBig(f)
 	}
-	if res.Value.String() == "true" {
-		return true, nil
+	return nil, fmt.Errorf("not a number: %v", o)
+}
+
+func floatToBig(f float64) (*big.Float, error) {
+	if math.IsNaN(f) {
+		return nil, fmt.Errorf("cannot compare NaN")
 	}
+	return new(big.Float).SetFloat64(f), nil
+}
 
-	return false, nil
+// cmpResult maps the result of a three-way comparison onto op.
+func cmpResult(c int, op string) bool {
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case ">=":
+		return c >= 0
+	case ">":
+		return c > 0
+	}
+	return false
 }
 
 func getFilterExpr(obj interface{}, key string) string {
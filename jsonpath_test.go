@@ -2,11 +2,15 @@ package jsonpath
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go/token"
 	"go/types"
+	"math"
 	"reflect"
 	"regexp"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -235,6 +239,19 @@ func Test_jsonpath_tokenize(t *testing.T) {
 	}
 }
 
+func Test_jsonpath_tokenize_invalid(t *testing.T) {
+	for _, query := range []string{"", "$.", "$..", "$.store..", "$.store."} {
+		tokens, err := parse(query)
+		t.Log(query, tokens, err)
+		if err == nil {
+			t.Errorf("query: %q, error not raised, got: %v", query, tokens)
+		}
+		if _, err := Compile(query); err == nil {
+			t.Errorf("query: %q, compile error not raised", query)
+		}
+	}
+}
+
 var parse_token_cases = []map[string]interface{}{
 
 	{
@@ -456,6 +473,40 @@ func Test_jsonpath_get_key(t *testing.T) {
 	fmt.Println(err, res)
 }
 
+func Test_jsonpath_get_key_interface_map(t *testing.T) {
+	// the shape gopkg.in/yaml.v2 decodes documents into
+	data := map[interface{}]interface{}{
+		"store": map[interface{}]interface{}{
+			"book": []interface{}{
+				map[interface{}]interface{}{"title": "Sayings of the Century", "price": 8.95},
+				map[interface{}]interface{}{"title": "Sword of Honour", "price": 12.99},
+			},
+			1: "one",
+		},
+	}
+
+	res, err := Get(data, "$.store.book[1].title")
+	t.Log(res, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Value() != "Sword of Honour" {
+		t.Errorf("exp: Sword of Honour, got: %v", res.Value())
+	}
+
+	res, err = Get(data, "$.store.1")
+	t.Log(res, err)
+	if err != nil || res.Value() != "one" {
+		t.Errorf("exp: one, got: %v, err: %v", res, err)
+	}
+
+	res, err = Get(data, "$.store.book[?(@.price > 10)].title")
+	t.Log(res, err)
+	if err != nil || fmt.Sprintf("%v", res.Value()) != "[Sword of Honour]" {
+		t.Errorf("exp: [Sword of Honour], got: %v, err: %v", res, err)
+	}
+}
+
 func Test_jsonpath_get_idx(t *testing.T) {
 	obj := []interface{}{1, 2, 3, 4}
 	res, err := getByIdx(obj, 0)
@@ -571,6 +622,75 @@ func Test_jsonpath_get_range(t *testing.T) {
 	}
 }
 
+func Test_jsonpath_get_range_clamp(t *testing.T) {
+	res, err := Get(json_data, "$.store.book[0:100].price")
+	if err == nil {
+		t.Errorf("strict mode should raise out of range error, got: %v", res.Value())
+	}
+
+	RangeBounds = RangeClamp
+	defer func() { RangeBounds = RangeStrict }()
+
+	res, err = Get(json_data, "$.store.book[0:100].price")
+	t.Log(err, res)
+	if err != nil {
+		t.Fatalf("failed to clamp [to]: %v", err)
+	}
+	if res_v, ok := res.Value().([]interface{}); ok != true || len(res_v) != 4 || res_v[3].(float64) != 22.99 {
+		t.Errorf("exp: [8.95, 12.99, 8.99, 22.99], got: %v", res.Value())
+	}
+
+	res, err = Get(json_data, "$.store.book[-100:].price")
+	t.Log(err, res)
+	if err != nil {
+		t.Fatalf("failed to clamp [from]: %v", err)
+	}
+	if res_v, ok := res.Value().([]interface{}); ok != true || len(res_v) != 4 || res_v[0].(float64) != 8.95 {
+		t.Errorf("exp: [8.95, 12.99, 8.99, 22.99], got: %v", res.Value())
+	}
+
+	obj := []int{1, 2, 3}
+	r, err := getByRange(obj, 5, 10)
+	if err != nil || len(r.([]int)) != 0 {
+		t.Errorf("exp: [], got: %v, err: %v", r, err)
+	}
+}
+
+func Test_jsonpath_get_range_step(t *testing.T) {
+	res, err := Get(json_data, "$.store.book[::-1].title")
+	t.Log(err, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles := res.Value().([]interface{})
+	if len(titles) != 4 || titles[0] != "The Lord of the Rings" || titles[3] != "Sayings of the Century" {
+		t.Errorf("exp reversed titles, got: %v", titles)
+	}
+
+	res, err = Get(json_data, "$.store.book[::2].price")
+	t.Log(err, res)
+	if fmt.Sprintf("%v", res.Value()) != "[8.95 8.99]" {
+		t.Errorf("exp: [8.95 8.99], got: %v", res.Value())
+	}
+
+	res, err = Get(json_data, "$.store.book[2:0:-1].price")
+	t.Log(err, res)
+	if fmt.Sprintf("%v", res.Value()) != "[8.99 12.99 8.95]" {
+		t.Errorf("exp: [8.99 12.99 8.95], got: %v", res.Value())
+	}
+
+	_, err = Compile("$.store.book[::0]")
+	if err == nil {
+		t.Errorf("zero step should raise error")
+	}
+
+	obj := []int{1, 2, 3}
+	r, err := getBySteppedRange(obj, nil, nil, -1)
+	if fmt.Sprintf("%v", r) != "[3 2 1]" {
+		t.Errorf("exp: [3 2 1], got: %v, err: %v", r, err)
+	}
+}
+
 func Test_jsonpath_types_eval(t *testing.T) {
 	fset := token.NewFileSet()
 	res, err := types.Eval(fset, nil, 0, "1 < 2")
@@ -802,6 +922,36 @@ func Test_jsonpath_eval_filter(t *testing.T) {
 	}
 }
 
+func Test_jsonpath_eval_filter_array_rp(t *testing.T) {
+	obj := map[string]interface{}{"price": 8.95}
+	root := map[string]interface{}{"thresholds": []interface{}{5, 10}}
+
+	for _, op := range []string{"<", "<=", "==", ">=", ">"} {
+		ok, err := evalFilter(obj, root, "@.price", op, "$.thresholds")
+		t.Log(op, ok, err)
+		if !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("op: %s, exp ErrTypeMismatch, got: %v", op, err)
+		}
+		if ok {
+			t.Errorf("op: %s, array rp should not match", op)
+		}
+	}
+
+	root = map[string]interface{}{"prices": []interface{}{8.95, 12.99}}
+	ok, err := evalFilter(obj, root, "@.price", "in", "$.prices")
+	if err != nil || !ok {
+		t.Errorf("8.95 should be in $.prices, got: %v, %v", ok, err)
+	}
+	ok, err = evalFilter(map[string]interface{}{"price": 1}, root, "@.price", "in", "$.prices")
+	if err != nil || ok {
+		t.Errorf("1 should not be in $.prices, got: %v, %v", ok, err)
+	}
+	_, err = evalFilter(obj, root, "@.price", "in", "$.prices[0]")
+	if !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("in a scalar should raise ErrTypeMismatch, got: %v", err)
+	}
+}
+
 var (
 	ifc1 interface{} = "haha"
 	ifc2 interface{} = "ha ha"
@@ -868,6 +1018,128 @@ var tcase_cmp_any = []map[string]interface{}{
 		"exp":  false,
 		"err":  nil,
 	},
+	// int vs float
+	{
+		"obj1": 1,
+		"obj2": 2.0,
+		"op":   "<",
+		"exp":  true,
+		"err":  nil,
+	}, {
+		"obj1": 2.0,
+		"obj2": 2,
+		"op":   "==",
+		"exp":  true,
+		"err":  nil,
+	}, {
+		"obj1": float32(0.5),
+		"obj2": int8(1),
+		"op":   "<",
+		"exp":  true,
+		"err":  nil,
+	}, {
+		"obj1": 1e21,
+		"obj2": int64(math.MaxInt64),
+		"op":   ">",
+		"exp":  true,
+		"err":  nil,
+	}, {
+		"obj1": int64(1<<53 + 1),
+		"obj2": float64(1 << 53),
+		"op":   ">",
+		"exp":  true,
+		"err":  nil,
+	}, {
+		"obj1": int64(math.MaxInt64),
+		"obj2": int64(math.MaxInt64 - 1),
+		"op":   "==",
+		"exp":  false,
+		"err":  nil,
+	}, {
+		"obj1": uint64(math.MaxUint64),
+		"obj2": float64(math.MaxUint64),
+		"op":   "<",
+		"exp":  true,
+		"err":  nil,
+	}, {
+		"obj1": json.Number("12.5"),
+		"obj2": 12,
+		"op":   ">",
+		"exp":  true,
+		"err":  nil,
+	}, {
+		"obj1": "1e3",
+		"obj2": 999.5,
+		"op":   ">=",
+		"exp":  true,
+		"err":  nil,
+	}, {
+		"obj1": math.NaN(),
+		"obj2": 1.0,
+		"op":   "<",
+		"exp":  false,
+		"err":  nil,
+	}, {
+		"obj1": math.NaN(),
+		"obj2": 1.0,
+		"op":   ">=",
+		"exp":  false,
+		"err":  nil,
+	}, {
+		"obj1": math.NaN(),
+		"obj2": math.NaN(),
+		"op":   "==",
+		"exp":  false,
+		"err":  nil,
+	}, {
+		"obj1": math.NaN(),
+		"obj2": math.NaN(),
+		"op":   "!=",
+		"exp":  true,
+		"err":  nil,
+	}, {
+		"obj1": 1,
+		"obj2": math.NaN(),
+		"op":   "==",
+		"exp":  false,
+		"err":  nil,
+	}, {
+		"obj1": math.Inf(1),
+		"obj2": math.MaxFloat64,
+		"op":   ">",
+		"exp":  true,
+		"err":  nil,
+	}, {
+		"obj1": math.Inf(1),
+		"obj2": math.Inf(1),
+		"op":   "==",
+		"exp":  true,
+		"err":  nil,
+	}, {
+		"obj1": math.Inf(-1),
+		"obj2": -1e308,
+		"op":   "<",
+		"exp":  true,
+		"err":  nil,
+	}, {
+		"obj1": math.Inf(1),
+		"obj2": math.NaN(),
+		"op":   ">",
+		"exp":  false,
+		"err":  nil,
+	}, {
+		"obj1": []interface{}{8.95, 12.99},
+		"obj2": 15,
+		"op":   ">",
+		"exp":  false,
+		"err":  nil,
+	}, {
+		"obj1": map[string]interface{}{"price": 19.95},
+		"obj2": 15,
+		"op":   ">",
+		"exp":  false,
+		"err":  nil,
+	},
 }
 
 func Test_jsonpath_cmp_any(t *testing.T) {
@@ -895,6 +1167,55 @@ func Test_jsonpath_cmp_any(t *testing.T) {
 	}
 }
 
+func Test_jsonpath_cmp_float_epsilon(t *testing.T) {
+	a, b := 0.1, 0.2
+	computed := a + b - b
+	data := map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"name": "a", "value": computed},
+			map[string]interface{}{"name": "b", "value": 0.5},
+		},
+	}
+
+	res, err := Get(data, "$.items[?(@.value == 0.1)].name")
+	t.Log(res, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Value().([]interface{})) != 0 {
+		t.Fatalf("exact compare should not match %v, got: %v", computed, res.Value())
+	}
+
+	res, err = Get(data, "$.items[?(@.value == 0.1)].name", FloatTolerance(1e-9))
+	t.Log(res, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", res.Value()) != "[a]" {
+		t.Fatalf("exp: [a], got: %v", res.Value())
+	}
+
+	res, err = Get(data, "$.items[?(@.value != 0.1)].name", FloatTolerance(1e-9))
+	t.Log(res, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", res.Value()) != "[b]" {
+		t.Fatalf("exp: [b], got: %v", res.Value())
+	}
+
+	// the tolerance applies to `in` and to the walk of LookupAllPaths too
+	data["targets"] = []interface{}{0.1, 0.7}
+	res, err = Get(data, "$.items[?(@.value in $.targets)].name", FloatTolerance(1e-9))
+	if err != nil || fmt.Sprintf("%v", res.Value()) != "[a]" {
+		t.Errorf("exp: [a], got: %v, err: %v", res, err)
+	}
+	matches, err := MustCompile("$..items[?(@.value == 0.1)].name", FloatTolerance(1e-9)).LookupAllPaths(data)
+	if err != nil || len(matches) != 1 || matches[0].Value != "a" {
+		t.Errorf("exp a single match a, got: %v, err: %v", matches, err)
+	}
+}
+
 func Test_jsonpath_string_equal(t *testing.T) {
 	data := `{
     "store": {
@@ -962,6 +1283,50 @@ func Test_jsonpath_null_in_the_middle(t *testing.T) {
 	t.Log(res, err)
 }
 
+func Test_jsonpath_null_result(t *testing.T) {
+	var j interface{}
+	json.Unmarshal([]byte(`{"head_commit": null, "id": 1}`), &j)
+
+	res, err := Get(j, "$.head_commit")
+	t.Log(res, err)
+	if err != nil {
+		t.Fatalf("present null should not raise error: %v", err)
+	}
+	if res.Value() != nil || !res.IsNull() {
+		t.Errorf("exp null result, got: %v", res.Value())
+	}
+
+	res, err = Get(j, "$.id")
+	if err != nil || res.IsNull() {
+		t.Errorf("exp non null result, got: %v, err: %v", res, err)
+	}
+
+	_, err = Get(j, "$.missing")
+	if err == nil {
+		t.Errorf("missing key should raise error")
+	}
+
+	_, err = Get(j, "$.head_commit.author.username")
+	t.Log(err)
+	if err != ErrGetFromNullObj {
+		t.Errorf("exp ErrGetFromNullObj, got: %v", err)
+	}
+
+	_, err = Get(nil, "$.head_commit")
+	if err == nil {
+		t.Errorf("nil root should raise error")
+	}
+
+	// null elements of an array are kept in the results
+	json.Unmarshal([]byte(`{"commits": [{"id": 1}, null, {"id": null}]}`), &j)
+	tcases := map[string]string{
+		"$.commits[*].id": "[1 <nil> <nil>]",
+		"$.commits.id":    "[1 <nil> <nil>]",
+		"$.commits[1:]":   "[<nil> map[id:<nil>]]",
+	}
+	testGet(t, j, tcases)
+}
+
 func Test_jsonpath_num_cmp(t *testing.T) {
 	data := `{
 	"books": [ 
@@ -1122,6 +1487,38 @@ func TestRegOp(t *testing.T) {
 	}
 }
 
+func TestRegOpRootPattern(t *testing.T) {
+	root := map[string]interface{}{
+		"pattern": "^T",
+		"slashed": "/(?i)^alice$/",
+		"number":  1,
+	}
+	tcases := []struct {
+		Name string
+		Rp   string
+		Exp  bool
+		Err  bool
+	}{
+		{"Tom", "$.pattern", true, false},
+		{"Alice", "$.pattern", false, false},
+		{"alice", "$.slashed", true, false},
+		{"Tom", "$.slashed", false, false},
+		{"Tom", "$.number", false, true},
+		{"Tom", "$.missing", false, false},
+	}
+	for idx, tcase := range tcases {
+		obj := map[string]interface{}{"name": tcase.Name}
+		ok, err := evalFilter(obj, root, "@.name", "=~", tcase.Rp)
+		t.Log(idx, ok, err)
+		if (err != nil) != tcase.Err {
+			t.Errorf("idx: %d, unexpected err: %v", idx, err)
+		}
+		if ok != tcase.Exp {
+			t.Errorf("idx: %d, %v(got) != %v(exp)", idx, ok, tcase.Exp)
+		}
+	}
+}
+
 func Test_jsonpath_rootnode_is_array(t *testing.T) {
 	data := `[{
     "test": 12.34
@@ -1290,6 +1687,73 @@ func Test_set_methods(t *testing.T) {
 	}
 }
 
+func TestSetMany(t *testing.T) {
+	jsonText := `{"hi": "there", "level1": {"level2": [1, 2, 3]}}`
+	data := map[string]interface{}{}
+	json.Unmarshal([]byte(jsonText), &data)
+
+	values := map[string]interface{}{
+		"$.hi":               "here",
+		"$.level1.level2[0]": 10,
+		"$.level1.level2[9]": 90,
+		"$.nope.level2":      0,
+	}
+	missing := map[string]error{}
+	err := SetMany(data, values, func(path string, err error) {
+		missing[path] = err
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	t.Log(data, missing)
+	if len(missing) != 2 || missing["$.level1.level2[9]"] == nil || missing["$.nope.level2"] == nil {
+		t.Errorf("exp 2 missing paths, got: %v", missing)
+	}
+	if data["hi"] != "here" {
+		t.Errorf("$.hi should be set, got: %v", data["hi"])
+	}
+	if data["level1"].(map[string]interface{})["level2"].([]interface{})[0] != 10 {
+		t.Errorf("$.level1.level2[0] should be set, got: %v", data["level1"])
+	}
+
+	err = SetMany(data, values, nil)
+	if err == nil {
+		t.Errorf("missing path should abort without onMissing")
+	}
+}
+
+func TestSetIf(t *testing.T) {
+	jsonText := `{"price": 8.95, "tags": ["a", "b"]}`
+	data := map[string]interface{}{}
+	json.Unmarshal([]byte(jsonText), &data)
+
+	ok, err := SetIf(data, "$.price", 8.95, 9.5)
+	if err != nil || !ok {
+		t.Errorf("matching expected value should be set, got: %v, err: %v", ok, err)
+	}
+	if data["price"] != 9.5 {
+		t.Errorf("exp: 9.5, got: %v", data["price"])
+	}
+
+	ok, err = SetIf(data, "$.price", 8.95, 10.0)
+	if err != nil || ok {
+		t.Errorf("stale expected value should not be set, got: %v, err: %v", ok, err)
+	}
+	if data["price"] != 9.5 {
+		t.Errorf("exp: 9.5, got: %v", data["price"])
+	}
+
+	ok, err = SetIf(data, "$.tags", []interface{}{"a", "b"}, []interface{}{"c"})
+	if err != nil || !ok {
+		t.Errorf("deep equal expected value should be set, got: %v, err: %v", ok, err)
+	}
+
+	_, err = SetIf(data, "$.missing.key", nil, 1)
+	if err == nil {
+		t.Errorf("missing path should raise error")
+	}
+}
+
 type Dog struct {
 	Name    string `json:"name"`
 	Color   string `json:"color"`
@@ -1342,6 +1806,49 @@ func TestGetAndSet(t *testing.T) {
 	fmt.Println(data, err)
 }
 
+// dogsData returns `{"dogs": [tom, tony]}` decoded from json, where only tom is
+// a friend of Alice.
+func dogsData() interface{} {
+	alice := &Dog{Name: "Alice", Color: "White", Age: 10, IsMan: true}
+	david := &Dog{Name: "David", Color: "White", Age: 9}
+	tony := &Dog{Name: "Tony", Color: "White", Age: 9, Wife: alice, Friends: []*Dog{david}}
+	tom := &Dog{Name: "Tom", Color: "Black", Age: 8, Friends: []*Dog{alice, tony, david}}
+
+	var data interface{}
+	marshal, _ := json.Marshal(map[string]interface{}{"dogs": []*Dog{tom, tony}})
+	_ = json.Unmarshal(marshal, &data)
+	return data
+}
+
+func TestFilterImplicitFlatten(t *testing.T) {
+	data := dogsData()
+
+	// the friends of tom, then those of tony
+	res, err := filterGetFromExplicitPath(data, "$.dogs.friends.name")
+	t.Log(res, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, []interface{}{"Alice", "Tony", "David", "David"}) {
+		t.Fatalf("exp: [Alice Tony David David], got: %v", res)
+	}
+
+	value, err := Get(data, "$.dogs[?(@.friends.name contains 'Alice')].name")
+	t.Log(value, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", value.Value()) != "[Tom]" {
+		t.Fatalf("exp: [Tom], got: %v", value.Value())
+	}
+
+	value, err = Get(data, "$.dogs[?(@.name contains 'o')].name")
+	t.Log(value, err)
+	if fmt.Sprintf("%v", value.Value()) != "[Tom Tony]" {
+		t.Fatalf("exp: [Tom Tony], got: %v", value.Value())
+	}
+}
+
 func TestOptimize(t *testing.T) {
 	docSchema := "{\"title\":\"1\",\"description\":\"1\",\"tips\":[{\"tipInfo\":\"1\",\"tipLevel\":\"tip\"},{\"tipInfo\":\"2\",\"tipLevel\":\"warn\"},{\"tipInfo\":\"3\",\"tipLevel\":\"error\"}],\"apiSchema\":{\"id\":\"project=ftc_test_one\\u0026version=v1\\u0026resource=pet_store\\u0026method=create\",\"domain\":\"https://open.feishu-boe.cn\",\"path\":\"/open-apis/ftc_test_one/v1/pets\",\"httpMethod\":\"POST\",\"parameters\":[{\"in\":\"query\",\"schema\":{\"name\":\"y\",\"type\":\"boolean\",\"description\":\"查询参数\",\"example\":\"false\",\"required\":true}},{\"in\":\"query\",\"schema\":{\"name\":\"user_id_type\",\"type\":\"string\",\"description\":\"用户 ID 类型\",\"example\":\"open_id\",\"format\":\"user_id_type\",\"default\":\"open_id\"}}],\"requestBody\":{\"content\":{\"multipart/form-data\":{\"schema\":{\"type\":\"object\",\"objectName\":\"file\",\"properties\":[{\"name\":\"file_type\",\"type\":\"string\",\"description\":\"文件类型1\",\"example\":\"111\",\"required\":true},{\"name\":\"file\",\"type\":\"string\",\"description\":\"文件流1\",\"example\":\"1\",\"format\":\"binary\",\"required\":true}]}}}},\"responses\":{\"200\":{\"content\":{\"application/json\":{\"schema\":{\"type\":\"object\",\"properties\":[{\"name\":\"code\",\"type\":\"integer\",\"description\":\"错误码，非 0 表示失败\",\"example\":\"0\",\"format\":\"int32\"},{\"name\":\"msg\",\"type\":\"string\",\"description\":\"错误描述\",\"example\":\"success\"},{\"name\":\"data\",\"type\":\"object\",\"description\":\"\\\\-\",\"properties\":[{\"name\":\"pet_store\",\"type\":\"object\",\"objectName\":\"pet_store\",\"description\":\"pet store\",\"properties\":[{\"name\":\"name\",\"type\":\"string\",\"description\":\"宠物名\",\"example\":\"tttt\"},{\"name\":\"type\",\"type\":\"integer\",\"description\":\"宠物类型：猫、狗\",\"example\":\"1\",\"format\":\"int32\",\"options\":[{\"name\":\"dog\",\"value\":\"0\",\"description\":\"狗1\"},{\"name\":\"cat\",\"value\":\"1\",\"description\":\"猫1\"}],\"default\":\"0\",\"minimum\":\"0\",\"maximum\":\"10\"},{\"name\":\"foods\",\"type\":\"array\",\"description\":\"吃的粮食种类\",\"items\":{\"type\":\"string\",\"example\":\"0\",\"options\":[{\"name\":\"fish\",\"value\":\"0\",\"description\":\"鱼\"},{\"name\":\"egg\",\"value\":\"1\",\"description\":\"蛋\"}]}}],\"scopeTags\":[\"contact:department.organize:readonly\",\"contact:contact:access_as_app\",\"contact:user.base:readonly\",\"contact:user.department:readonly\",\"contact:user.gender:readonly\",\"contact:contact:readonly_as_app\"]},{\"name\":\"pet_store2\",\"type\":\"string\",\"description\":\"pet_store2\",\"example\":\"asd\",\"scopeTags\":[\"contact:user.phone:readonly\",\"contact:department.base:readonly\",\"contact:contact:access_as_app\",\"contact:department.organize:readonly\"],\"required\":true}]}]}}}},\"errorCodeMapping\":[{\"errorCode\":1644129876,\"statusCode\":200,\"description\":\"全局错误码11\",\"troubleShootingSuggestion\":\"1\"},{\"errorCode\":1644129875,\"statusCode\":400,\"description\":\"错误码21\",\"troubleShootingSuggestion\":\"11\"}]},\"security\":{\"requiredScopes\":[\"contact:user.email:readonly\"],\"fieldRequiredScopes\":[\"contact:contact:access_as_app\",\"contact:contact:readonly_as_app\",\"contact:department.base:readonly\",\"contact:department.organize:readonly\",\"contact:user.base:readonly\",\"contact:user.department:readonly\",\"contact:user.gender:readonly\",\"contact:user.phone:readonly\"],\"supportedAccessToken\":[\"tenant_access_token\"],\"rateLimitTier\":1}},\"localChangeable\":[\"$.title\",\"$.description\",\"$.apiSchema.responses.errorCodeMapping[0].troubleShootingSuggestion\",\"$.apiSchema.responses.errorCodeMapping[1].troubleShootingSuggestion\",\"$.tips[0].tipInfo\",\"$.tips[1].tipInfo\",\"$.tips[2].tipInfo\",\"$.apiSchema.parameters[0].schema.description\",\"$.apiSchema.parameters[0].schema.example\",\"$.apiSchema.requestBody.content.multipart/form-data.schema.properties[0].description\",\"$.apiSchema.requestBody.content.multipart/form-data.schema.properties[0].example\",\"$.apiSchema.requestBody.content.multipart/form-data.schema.properties[1].description\",\"$.apiSchema.requestBody.content.multipart/form-data.schema.properties[1].example\",\"$.apiSchema.responses.200.content.application/json.schema.properties[2].properties[0].properties[1].options[0].description\",\"$.apiSchema.responses.200.content.application/json.schema.properties[2].properties[0].properties[1].options[1].description\",\"$.apiSchema.responses.errorCodeMapping[0].description\",\"$.apiSchema.responses.errorCodeMapping[1].description\"]}"
 	//docSchema := "{\n    \"phoneNumbers\": [\n        {\n            \"type\": \"home\",\n            \"number\": 104,\n            \"test\":[\n                    {\n                        \"type\": \"home\",\n                        \"number\": 104\n                    },\n                    {\n                        \"type\": \"home\",\n                        \"number\": 119\n                    }\n            ]\n        },\n        {\n            \"name\":\"zhangsan\",\n            \"type\": \"home\",\n            \"number\": 119,\n            \"test\":[\n                {\n                    \"type\": \"home1\",\n                    \"number\": 104\n                },\n                {\n                    \"type\": \"home\",\n                    \"number\": 119\n                }\n            ]\n        }\n    ]\n    \n}"
@@ -1355,3 +1862,2898 @@ func TestOptimize(t *testing.T) {
 	value, err2 := Get(data, path)
 	fmt.Println(value.Value(), err2)
 }
+
+func TestGetMatchingKeys(t *testing.T) {
+	keys, err := GetMatchingKeys(json_data, "$.store[?(@.price > 15)]")
+	t.Log(keys, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "bicycle" {
+		t.Fatalf("exp: [bicycle], got: %v", keys)
+	}
+
+	keys, err = GetMatchingKeys(json_data, "$[?(@.bicycle)]")
+	t.Log(keys, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "store" {
+		t.Fatalf("exp: [store], got: %v", keys)
+	}
+
+	_, err = GetMatchingKeys(json_data, "$.store.book[?(@.isbn)]")
+	if err == nil {
+		t.Fatal("filter on array should raise error")
+	}
+
+	_, err = GetMatchingKeys(json_data, "$.store.bicycle")
+	if err == nil {
+		t.Fatal("path without filter should raise error")
+	}
+}
+
+func TestCompiledCost(t *testing.T) {
+	paths := []string{
+		"$.expensive",
+		"$.store.book[0].title",
+		"$.store.book[*].title",
+		"$.store.book[?(@.price > 10)].title",
+		"$..book[?(@.price > 10)].title",
+	}
+	last := -1
+	for _, path := range paths {
+		cost := MustCompile(path).Cost()
+		t.Log(path, cost)
+		if cost <= last {
+			t.Errorf("cost of %s should be higher than %d, got: %d", path, last, cost)
+		}
+		last = cost
+	}
+}
+
+func TestGetFromReader(t *testing.T) {
+	data, _ := json.Marshal(json_data)
+
+	res, err := GetFromReader(strings.NewReader(string(data)), "$.store.bicycle.color")
+	t.Log(res, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Value() != "red" {
+		t.Errorf("exp: red, got: %v", res.Value())
+	}
+
+	res, err = GetFromReader(strings.NewReader(string(data)), "$.store.book[?(@.price < 10)].title")
+	t.Log(res, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", res.Value()) != "[Sayings of the Century Moby Dick]" {
+		t.Errorf("exp: [Sayings of the Century Moby Dick], got: %v", res.Value())
+	}
+
+	_, err = GetFromReader(strings.NewReader("{"), "$.a")
+	if err == nil {
+		t.Errorf("invalid json should raise error")
+	}
+}
+
+func TestCompiledFields(t *testing.T) {
+	tcases := map[string]string{
+		"$.expensive":                                    "[expensive]",
+		"$.store.book[?(@.price > 10)].title":            "[store book price title]",
+		"$.store.book[?(@.price < $.expensive)].title":   "[store book price expensive title]",
+		"$..book[0,1].author":                            "[book author]",
+		"$.store.book[*].author":                         "[store book author]",
+		"$[?(@.color == 'White' && @.wife.name == 'x')]": "[color wife name]",
+	}
+	for path, exp := range tcases {
+		fields := MustCompile(path).Fields()
+		t.Log(path, fields)
+		if fmt.Sprintf("%v", fields) != exp {
+			t.Errorf("path: %s, exp: %s, got: %v", path, exp, fields)
+		}
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	res, err := Get(json_data, "$.Store.Book[0].Title")
+	if err == nil {
+		t.Fatalf("keys should be case sensitive by default, got: %v", res.Value())
+	}
+
+	res, err = Get(json_data, "$.Store.Book[0].Title", CaseInsensitive())
+	t.Log(res, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Value() != "Sayings of the Century" {
+		t.Errorf("exp: Sayings of the Century, got: %v", res.Value())
+	}
+
+	res, err = Get(json_data, "$.STORE.book[?(@.price > 20)].title", CaseInsensitive())
+	t.Log(res, err)
+	if err != nil || fmt.Sprintf("%v", res.Value()) != "[The Lord of the Rings]" {
+		t.Errorf("exp: [The Lord of the Rings], got: %v, err: %v", res, err)
+	}
+
+	data := map[string]interface{}{"ab": 1, "AB": 2, "Ab": 3}
+	res, err = Get(data, "$.AB", CaseInsensitive())
+	if err != nil || res.Value() != 2 {
+		t.Errorf("exact match should win, got: %v, err: %v", res, err)
+	}
+	_, err = Get(data, "$.aB", CaseInsensitive())
+	t.Log(err)
+	if err == nil {
+		t.Errorf("ambiguous key error not raised")
+	}
+}
+
+func TestGetEntries(t *testing.T) {
+	entries, err := GetEntries(json_data, "$.store.bicycle.*")
+	t.Log(entries, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", entries) != "[{color red} {price 19.95}]" {
+		t.Errorf("exp: [{color red} {price 19.95}], got: %v", entries)
+	}
+
+	entries, err = GetEntries(json_data, "$.store.bicycle")
+	if err != nil || len(entries) != 2 {
+		t.Errorf("exp 2 entries, got: %v, err: %v", entries, err)
+	}
+
+	entries, err = GetEntries(json_data, "$.store.book[0,1].title")
+	t.Log(entries, err)
+	if err != nil || fmt.Sprintf("%v", entries) != "[{0 Sayings of the Century} {1 Sword of Honour}]" {
+		t.Errorf("exp indexed entries, got: %v, err: %v", entries, err)
+	}
+
+	_, err = GetEntries(json_data, "$.expensive")
+	if err == nil {
+		t.Errorf("entries of a scalar should raise error")
+	}
+}
+
+func TestLookupRelative(t *testing.T) {
+	store := json_data.(map[string]interface{})["store"]
+	book := store.(map[string]interface{})["book"].([]interface{})[0]
+
+	res, err := LookupRelative(book, "@.price")
+	t.Log(res, err)
+	if err != nil || res.Value() != 8.95 {
+		t.Errorf("exp: 8.95, got: %v, err: %v", res, err)
+	}
+
+	res, err = LookupRelative(store, "@.book[0].title")
+	t.Log(res, err)
+	if err != nil || res.Value() != "Sayings of the Century" {
+		t.Errorf("exp: Sayings of the Century, got: %v, err: %v", res, err)
+	}
+
+	res, err = LookupRelative(store, "@.book[?(@.price > 20)].title")
+	t.Log(res, err)
+	if err != nil || fmt.Sprintf("%v", res.Value()) != "[The Lord of the Rings]" {
+		t.Errorf("exp: [The Lord of the Rings], got: %v, err: %v", res, err)
+	}
+
+	res, err = LookupRelative(book, "@")
+	if err != nil || res.Value().(map[string]interface{})["price"] != 8.95 {
+		t.Errorf("@ should return the node itself, got: %v, err: %v", res, err)
+	}
+
+	_, err = LookupRelative(store, "$.book[0].title")
+	if err == nil {
+		t.Errorf("absolute path should raise error")
+	}
+}
+
+func TestLookupMap(t *testing.T) {
+	res, err := MustCompile("$..price").LookupMap(json_data)
+	t.Log(res, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]interface{}{
+		"$.store.bicycle.price": 19.95,
+		"$.store.book[0].price": 8.95,
+		"$.store.book[1].price": 12.99,
+		"$.store.book[2].price": 8.99,
+		"$.store.book[3].price": 22.99,
+	}
+	if !reflect.DeepEqual(res, exp) {
+		t.Errorf("exp: %v, got: %v", exp, res)
+	}
+
+	c := MustCompile("$.store.book[?(@.price < $.expensive)].title")
+	for i := 0; i < 2; i++ {
+		res, err = c.LookupMap(json_data)
+		t.Log(res, err)
+		exp = map[string]interface{}{
+			"$.store.book[0].title": "Sayings of the Century",
+			"$.store.book[2].title": "Moby Dick",
+		}
+		if err != nil || !reflect.DeepEqual(res, exp) {
+			t.Errorf("exp: %v, got: %v, err: %v", exp, res, err)
+		}
+	}
+
+	res, err = MustCompile("$.store.book[-1:].isbn").LookupMap(json_data)
+	if err != nil || !reflect.DeepEqual(res, map[string]interface{}{"$.store.book[3].isbn": "0-395-19395-8"}) {
+		t.Errorf("got: %v, err: %v", res, err)
+	}
+
+	res, err = MustCompile("$.store.bicycle.*").LookupMap(json_data)
+	if err != nil || !reflect.DeepEqual(res, map[string]interface{}{"$.store.bicycle.color": "red", "$.store.bicycle.price": 19.95}) {
+		t.Errorf("got: %v, err: %v", res, err)
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	res := Flatten(json_data)
+	t.Log(res)
+	if len(res) != 21 {
+		t.Errorf("exp 21 leaves, got: %d", len(res))
+	}
+	spots := map[string]interface{}{
+		"$.expensive":           10.0,
+		"$.store.book[0].price": 8.95,
+		"$.store.book[3].isbn":  "0-395-19395-8",
+		"$.store.bicycle.color": "red",
+	}
+	for path, exp := range spots {
+		if res[path] != exp {
+			t.Errorf("path: %s, exp: %v, got: %v", path, exp, res[path])
+		}
+	}
+
+	res = Flatten(map[string]interface{}{
+		"a.b":  1,
+		"it's": 2,
+		"":     3,
+		"x":    map[string]interface{}{},
+		"y":    []interface{}{},
+	})
+	t.Log(res)
+	exp := map[string]interface{}{
+		"$['a.b']":   1,
+		`$['it\'s']`: 2,
+		"$['']":      3,
+		"$.x":        map[string]interface{}{},
+		"$.y":        []interface{}{},
+	}
+	if !reflect.DeepEqual(res, exp) {
+		t.Errorf("exp: %v, got: %v", exp, res)
+	}
+
+	res = Flatten(42.0)
+	if len(res) != 1 || res["$"] != 42.0 {
+		t.Errorf("exp: map[$:42], got: %v", res)
+	}
+}
+
+func TestUnflatten(t *testing.T) {
+	res, err := Unflatten(Flatten(json_data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, json_data) {
+		t.Errorf("round trip failed, got: %v", res)
+	}
+
+	special := map[string]interface{}{
+		"a.b":  1.0,
+		"it's": []interface{}{nil, "x"},
+		"e":    map[string]interface{}{},
+	}
+	res, err = Unflatten(Flatten(special))
+	t.Log(res, err)
+	if err != nil || !reflect.DeepEqual(res, special) {
+		t.Errorf("round trip failed, got: %v, err: %v", res, err)
+	}
+
+	res, err = Unflatten(map[string]interface{}{"$.a[2]": 1})
+	t.Log(res, err)
+	if err != nil || fmt.Sprintf("%v", res) != "map[a:[<nil> <nil> 1]]" {
+		t.Errorf("exp: map[a:[<nil> <nil> 1]], got: %v, err: %v", res, err)
+	}
+
+	conflicts := []map[string]interface{}{
+		{"$.a": 1, "$.a.b": 2},
+		{"$.a": 1, "$.a[0]": 2},
+		{"$.a.b": 1, "$.a[0]": 2},
+		{"$.a": 1, "$['a']": 2},
+		{"$.a[0]": nil, "$.a[0].b": 2},
+		{"$.a[1]": nil, "$.a[1][0]": 2},
+	}
+	for idx, pairs := range conflicts {
+		res, err = Unflatten(pairs)
+		t.Log(idx, res, err)
+		if err == nil {
+			t.Errorf("idx: %d, conflict error not raised", idx)
+		}
+	}
+
+	for _, path := range []string{"a", "$.", "$[x]", "$[-1]", "$['a", "$[0"} {
+		if _, err = Unflatten(map[string]interface{}{path: 1}); err == nil {
+			t.Errorf("path: %s, invalid path error not raised", path)
+		}
+	}
+}
+
+func TestCompiledDepth(t *testing.T) {
+	tcases := map[string]int{
+		"$":                                   0,
+		"$.expensive":                         1,
+		"$.store.book[0].title":               3,
+		"$.store.book[?(@.price > 10)].title": 3,
+		"$..author":                           UnboundedDepth,
+		"$.store.*":                           UnboundedDepth,
+	}
+	for path, exp := range tcases {
+		if depth := MustCompile(path).Depth(); depth != exp {
+			t.Errorf("path: %s, exp: %d, got: %d", path, exp, depth)
+		}
+	}
+}
+
+func TestWithDelimiter(t *testing.T) {
+	tcases := map[string]string{
+		"$/store/book[0]/title":                 "$.store.book[0].title",
+		"$/store/book/0/title":                  "$.store.book[0].title",
+		"$/store/book/3/isbn":                   "$.store.book[3].isbn",
+		"$/store/book[?(@.price > 10)]/title":   "$.store.book[?(@.price > 10)].title",
+		"$/store/bicycle/color":                 "$.store.bicycle.color",
+		"$/store/book[-1:]/isbn":                "$.store.book[-1:].isbn",
+		"$/store/book[?(@.author =~ /.*Rees/)]": "$.store.book[?(@.author =~ /.*Rees/)]",
+	}
+	for slashed, dotted := range tcases {
+		exp, err := Get(json_data, dotted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := Get(json_data, slashed, WithDelimiter('/'))
+		t.Log(slashed, res, err)
+		if err != nil {
+			t.Errorf("path: %s, err: %v", slashed, err)
+			continue
+		}
+		if !reflect.DeepEqual(res.Value(), exp.Value()) {
+			t.Errorf("path: %s, exp: %v, got: %v", slashed, exp.Value(), res.Value())
+		}
+	}
+
+	data := map[string]interface{}{"codes": map[string]interface{}{"0": "zero"}}
+	if res, err := Get(data, "$/codes/0", WithDelimiter('/')); err != nil || res.Value() != "zero" {
+		t.Errorf("a numeric segment should still look up a map key, got: %v, err: %v", res, err)
+	}
+	if err := Set(data, "$/codes/0", "none", WithDelimiter('/')); err != nil || data["codes"].(map[string]interface{})["0"] != "none" {
+		t.Errorf("exp the map key set, got: %v, err: %v", data, err)
+	}
+
+	tokens, err := parseWith("$/store//price", '/')
+	if err != nil || fmt.Sprintf("%v", tokens) != "[$ store * price]" {
+		t.Errorf("exp: [$ store * price], got: %v, err: %v", tokens, err)
+	}
+
+	for _, d := range []byte{'[', '$', 0xff} {
+		if _, err := Compile("$.a", WithDelimiter(d)); err == nil {
+			t.Errorf("delimiter %q should be rejected", d)
+		}
+	}
+}
+
+func TestProject(t *testing.T) {
+	template := map[string]string{
+		"name":    "$.store.book[0].title",
+		"cost":    "$.store.book[0].price",
+		"missing": "$.store.book[0].isbn",
+	}
+	res, err := Project(json_data, template, false)
+	t.Log(res, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]interface{}{
+		"name":    "Sayings of the Century",
+		"cost":    8.95,
+		"missing": nil,
+	}
+	if !reflect.DeepEqual(res, exp) {
+		t.Errorf("exp: %v, got: %v", exp, res)
+	}
+
+	res, err = Project(json_data, template, true)
+	t.Log(res, err)
+	delete(exp, "missing")
+	if err != nil || !reflect.DeepEqual(res, exp) {
+		t.Errorf("exp: %v, got: %v, err: %v", exp, res, err)
+	}
+
+	_, err = Project(json_data, map[string]string{"bad": "store"}, false)
+	if err == nil {
+		t.Errorf("invalid path should raise error")
+	}
+	_, err = Project(json_data, map[string]string{"ids": "$.store.book[*].price"}, false, MaxNodes(3))
+	if !errors.Is(err, ErrTooManyNodes) {
+		t.Errorf("exp ErrTooManyNodes, got: %v", err)
+	}
+	_, err = Project(json_data, map[string]string{"title": "$.store.book.title"}, false, DisallowImplicitDescent())
+	if err == nil {
+		t.Errorf("an array where an object is expected should raise error")
+	}
+}
+
+func TestNumericKeysAsIndex(t *testing.T) {
+	var asMap, asArray interface{}
+	json.Unmarshal([]byte(`{"0": {"name": "zero"}}`), &asMap)
+	json.Unmarshal([]byte(`[{"name": "first"}, {"name": "second"}]`), &asArray)
+
+	res, err := Get(asMap, "$.0.name")
+	if err != nil || res.Value() != "zero" {
+		t.Errorf("exp: zero, got: %v, err: %v", res, err)
+	}
+	res, err = Get(asArray, "$.0.name")
+	if err == nil && res.Value() == "first" {
+		t.Errorf("numeric key should not index into array by default")
+	}
+
+	res, err = Get(asMap, "$.0.name", NumericKeysAsIndex())
+	if err != nil || res.Value() != "zero" {
+		t.Errorf("exp: zero, got: %v, err: %v", res, err)
+	}
+	res, err = Get(asArray, "$.0.name", NumericKeysAsIndex())
+	t.Log(res, err)
+	if err != nil || res.Value() != "first" {
+		t.Errorf("exp: first, got: %v, err: %v", res, err)
+	}
+	res, err = Get(json_data, "$.store.book.-1.title", NumericKeysAsIndex())
+	if err != nil || res.Value() != "The Lord of the Rings" {
+		t.Errorf("exp: The Lord of the Rings, got: %v, err: %v", res, err)
+	}
+	res, err = Get(json_data, "$/store/book/1/title", NumericKeysAsIndex(), WithDelimiter('/'))
+	if err != nil || res.Value() != "Sword of Honour" {
+		t.Errorf("exp: Sword of Honour, got: %v, err: %v", res, err)
+	}
+
+	err = MustCompile("$.1.name", NumericKeysAsIndex()).Set(asArray, "changed")
+	if err != nil || asArray.([]interface{})[1].(map[string]interface{})["name"] != "changed" {
+		t.Errorf("set through numeric key failed: %v, err: %v", asArray, err)
+	}
+	err = MustCompile("$.0", NumericKeysAsIndex()).Set(asArray, "replaced")
+	if err != nil || asArray.([]interface{})[0] != "replaced" {
+		t.Errorf("set numeric key failed: %v, err: %v", asArray, err)
+	}
+}
+
+func Test_jsonpath_get_script_index(t *testing.T) {
+	tcases := map[string]string{
+		"$.store.book[(@.length-1)].title":   "The Lord of the Rings",
+		"$.store.book[(@.length-2)].title":   "Moby Dick",
+		"$.store.book[(@.length / 2)].title": "Moby Dick",
+		"$.store.book[(@.length-1*3)].title": "Sword of Honour",
+		"$.store.book[(1+@.length*0)].title": "Sword of Honour",
+	}
+	for path, exp := range tcases {
+		res, err := Get(json_data, path)
+		t.Log(path, res, err)
+		if err != nil {
+			t.Errorf("path: %s, err: %v", path, err)
+			continue
+		}
+		if fmt.Sprintf("%v", res.Value()) != exp && fmt.Sprintf("%v", res.Value()) != "["+exp+"]" {
+			t.Errorf("path: %s, exp: %s, got: %v", path, exp, res.Value())
+		}
+	}
+
+	for _, path := range []string{"$.store.book[(@.size-1)]", "$.store.book[(@.length-x)]"} {
+		if _, err := Compile(path); err == nil {
+			t.Errorf("path: %s, should be invalid", path)
+		}
+	}
+	if _, err := Get(json_data, "$.store.book[(@.length/0)]"); err == nil {
+		t.Errorf("division by zero should fail")
+	}
+	if _, err := Get(json_data, "$.store.book[(@.length)]"); err == nil {
+		t.Errorf("index out of range should fail")
+	}
+}
+
+// testGet runs Get on obj for every path of tcases and compares the printed
+// value with the expected one.
+func testGet(t *testing.T, obj interface{}, tcases map[string]string) {
+	t.Helper()
+	for path, exp := range tcases {
+		res, err := Get(obj, path)
+		t.Log(path, res, err)
+		if err != nil || fmt.Sprintf("%v", res.Value()) != exp {
+			t.Errorf("path: %s, exp: %s, got: %v, err: %v", path, exp, res, err)
+		}
+	}
+}
+
+func TestLookupRawMessage(t *testing.T) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(`{"a": {"b": 1}, "list": [{"b": 2}, {"b": 3}]}`), &obj); err != nil {
+		t.Fatal(err)
+	}
+
+	tcases := map[string]string{
+		"$.a.b":                "1",
+		"$.list[1].b":          "3",
+		"$.list[0:].b":         "[2 3]",
+		"$.list[?(@.b > 2)].b": "[3]",
+	}
+	testGet(t, obj, tcases)
+
+	// a RawMessage leaf is returned without decoding
+	res, err := Get(obj, "$.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw, ok := res.Value().(json.RawMessage); !ok || string(raw) != `{"b": 1}` {
+		t.Errorf("exp raw message, got: %#v", res.Value())
+	}
+
+	paths, err := MustCompile("$.list[*].b").LookupMap(obj)
+	if err != nil || fmt.Sprintf("%v", paths) != "map[$.list[0].b:2 $.list[1].b:3]" {
+		t.Errorf("unexpected LookupMap result: %v, err: %v", paths, err)
+	}
+
+	// a RawMessage holding null can't be descended into
+	_, err = Get(map[string]json.RawMessage{"a": json.RawMessage("null")}, "$.a.b")
+	if !errors.Is(err, ErrGetFromNullObj) {
+		t.Errorf("exp ErrGetFromNullObj, got: %v", err)
+	}
+}
+
+func Test_jsonpath_eval_filter_quoted_number(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`{"addresses": [
+		{"city": "a", "zip": "01234"},
+		{"city": "b", "zip": "1234"},
+		{"city": "c", "zip": 1234}
+	]}`), &obj)
+
+	tcases := map[string]string{
+		"$.addresses[?(@.zip == '01234')].city": "[a]",
+		"$.addresses[?(@.zip == '1234')].city":  "[b c]",
+		"$.addresses[?(@.zip == 1234)].city":    "[a b c]",
+		"$.addresses[?(@.zip != '01234')].city": "[b c]",
+		"$.addresses[?(@.zip < '1')].city":      "[a]",
+	}
+	testGet(t, obj, tcases)
+}
+
+func TestResultForEach(t *testing.T) {
+	res, err := Get(json_data, "$.store.book[*].price")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, count := 0.0, 0
+	res.ForEach(func(i int, v interface{}) {
+		if i != count {
+			t.Errorf("exp index: %d, got: %d", count, i)
+		}
+		sum += v.(float64)
+		count++
+	})
+	if count != 4 || math.Abs(sum-53.92) > 1e-9 {
+		t.Errorf("exp 4 prices summing to 53.92, got: %d, %v", count, sum)
+	}
+
+	typed := &Result{value: []int{1, 2, 3}, isArray: true}
+	total := 0
+	typed.ForEach(func(i int, v interface{}) {
+		total += v.(int)
+	})
+	if total != 6 {
+		t.Errorf("exp: 6, got: %d", total)
+	}
+
+	res, _ = Get(json_data, "$.expensive")
+	calls := 0
+	res.ForEach(func(i int, v interface{}) {
+		if i != 0 || v != 10.0 {
+			t.Errorf("exp: 0 10, got: %d %v", i, v)
+		}
+		calls++
+	})
+	if calls != 1 {
+		t.Errorf("exp one call for a scalar, got: %d", calls)
+	}
+
+	var null *Result
+	null.ForEach(func(i int, v interface{}) {
+		t.Errorf("nil result should not be iterated")
+	})
+	(&Result{}).ForEach(func(i int, v interface{}) {
+		t.Errorf("null value should not be iterated")
+	})
+}
+
+func Test_jsonpath_eval_filter_length(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`{"orders": [
+		{"id": 1, "items": ["a"]},
+		{"id": 2, "items": ["a", "b"]},
+		{"id": 3, "items": ["a", "b", "c", "d", "e"]},
+		{"id": 4, "items": ["a", "b", "c", "d", "e", "f"]},
+		{"id": 5, "items": {"length": 3}},
+		{"id": 6, "items": [{"length": 10}, {"length": 20}]}
+	]}`), &obj)
+
+	tcases := map[string]string{
+		"$.orders[?(@.items.length >= 2 && @.items.length <= 5)].id": "[2 3 5]",
+		"$.orders[?(@.items.length == 1)].id":                        "[1]",
+		"$.orders[?(@.items.length > 5)].id":                         "[4]",
+		// elements with a length key of their own shadow the size
+		"$.orders[?(@.items.length contains 20)].id": "[6]",
+		"$.orders[?(@.items.length == 2)].id":        "[2]",
+	}
+	testGet(t, obj, tcases)
+}
+
+func TestErrInvalidPath(t *testing.T) {
+	invalid := []string{
+		"",
+		"store.book",
+		"$.store.",
+		"$.store..",
+		"$.store.book[a]",
+		"$.store.book[1:2:0]",
+		"$.store.book[x",
+		"$.store.book[(@.size)]",
+	}
+	for _, path := range invalid {
+		_, err := Compile(path)
+		t.Log(path, err)
+		if !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("path: %q, exp ErrInvalidPath, got: %v", path, err)
+		}
+	}
+
+	_, err := Get(json_data, "$.store.missing")
+	if err == nil || errors.Is(err, ErrInvalidPath) {
+		t.Errorf("a missing key should not be ErrInvalidPath, got: %v", err)
+	}
+	_, err = Get(json_data, "$.store.book[10]")
+	if err == nil || errors.Is(err, ErrInvalidPath) {
+		t.Errorf("an index out of range should not be ErrInvalidPath, got: %v", err)
+	}
+}
+
+func TestErrNotFound(t *testing.T) {
+	notFound := []string{
+		"$.store.missing",
+		"$.store.book[10]",
+		"$.store.book[0].missing",
+		"$.store.book[-10:-8]",
+		"$.store.bicycle.missing | $.store.missing",
+	}
+	for _, path := range notFound {
+		_, err := Get(json_data, path)
+		t.Log(path, err)
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("path: %s, exp ErrNotFound, got: %v", path, err)
+		}
+	}
+
+	for _, path := range []string{"$.store.book[", "$.store.book[?(@.price > )]"} {
+		if _, err := Get(json_data, path); errors.Is(err, ErrNotFound) {
+			t.Errorf("path: %s, a syntax error should not be ErrNotFound", path)
+		}
+	}
+}
+
+func TestStructWildcard(t *testing.T) {
+	type address struct {
+		City string `json:"city"`
+	}
+	type user struct {
+		Name     string `json:"name"`
+		Age      int    `json:"age,omitempty"`
+		Password string `json:"-"`
+		Address  *address
+		internal string
+	}
+	obj := map[string]interface{}{
+		"user": user{Name: "tom", Age: 30, Password: "secret", Address: &address{City: "paris"}, internal: "x"},
+	}
+
+	res, err := Get(obj, "$.user[*]")
+	t.Log(res, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := res.Value().([]interface{})
+	if len(values) != 3 || values[0] != "tom" || values[1] != 30 {
+		t.Errorf("exp fields in declaration order, got: %v", values)
+	}
+
+	// `.*` matches every descendant, so the fields of Address follow it
+	res, err = Get(obj, "$.user.*")
+	t.Log(res, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values = res.Value().([]interface{})
+	if len(values) != 4 || values[0] != "tom" || values[1] != 30 || values[3] != "paris" {
+		t.Errorf("exp fields and nested fields in declaration order, got: %v", values)
+	}
+
+	paths, err := MustCompile("$.user[*]").LookupMap(obj)
+	t.Log(paths, err)
+	if _, ok := paths["$.user.Address"]; err != nil || len(paths) != 3 || paths["$.user.name"] != "tom" || !ok {
+		t.Errorf("unexpected LookupMap result: %v, err: %v", paths, err)
+	}
+
+	flat := Flatten(obj)
+	t.Log(flat)
+	if len(flat) != 3 || flat["$.user.Address.city"] != "paris" || flat["$.user.age"] != 30 {
+		t.Errorf("unexpected Flatten result: %v", flat)
+	}
+}
+
+func TestStructCycle(t *testing.T) {
+	type node struct {
+		Name string `json:"name"`
+		Next *node  `json:"next"`
+	}
+	n := &node{Name: "a"}
+	n.Next = &node{Name: "b", Next: n}
+	obj := map[string]interface{}{"head": n}
+
+	flat := Flatten(obj)
+	t.Log(flat)
+	if len(flat) != 2 || flat["$.head.name"] != "a" || flat["$.head.next.name"] != "b" {
+		t.Errorf("exp the names of both nodes, got: %v", flat)
+	}
+
+	// struct fields are reached by wildcards: head, name, next, next.name and
+	// next.next, which is head again and not descended into
+	paths, err := MustCompile("$..*").LookupAllPaths(obj)
+	t.Log(paths, err)
+	if err != nil || len(paths) != 5 {
+		t.Errorf("exp 5 paths, got: %v, err: %v", paths, err)
+	}
+
+	res, err := Get(obj, "$.head.*")
+	t.Log(res, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values := res.Value().([]interface{}); len(values) != 4 || values[0] != "a" || values[2] != "b" {
+		t.Errorf("exp [a next b head], got: %v", values)
+	}
+
+	visited := 0
+	if _, err := WalkAll(obj, func(path string, value interface{}) (interface{}, bool) {
+		visited++
+		return nil, false
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// $, head, name, next, next.name and next.next, which is head again
+	if visited != 6 {
+		t.Errorf("exp 6 nodes visited, got: %d", visited)
+	}
+}
+
+func TestLookupTrace(t *testing.T) {
+	res, trace, err := MustCompile("$.store.book[?(@.price > 10)].title").LookupTrace(json_data)
+	t.Log(res, trace, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", res) != "[Sword of Honour The Lord of the Rings]" {
+		t.Errorf("unexpected result: %v", res)
+	}
+	exp := []TraceStep{
+		{Op: "key", Key: "store", Matched: true, Nodes: 1},
+		{Op: "filter", Key: "book", Selector: "[?(@.price > 10)]", Matched: true, Nodes: 2},
+		{Op: "key", Key: "title", Matched: true, Nodes: 2},
+	}
+	if !reflect.DeepEqual(trace, exp) {
+		t.Errorf("exp: %v, got: %v", exp, trace)
+	}
+
+	res, trace, err = MustCompile("$.store.book[?(@.price > 100)].title").LookupTrace(json_data)
+	t.Log(res, trace, err)
+	if err == nil || len(trace) != 2 || trace[1].Matched || trace[1].Nodes != 0 {
+		t.Errorf("exp trace to stop at the filter, got: %v, err: %v", trace, err)
+	}
+
+	res, trace, err = MustCompile("$..book[0].author").LookupTrace(json_data)
+	t.Log(res, trace, err)
+	if err != nil || len(trace) != 2 || trace[0].Op != "scan" || trace[0].Selector != "[0]" || fmt.Sprintf("%v", res) != "[Nigel Rees]" {
+		t.Errorf("unexpected scan trace: %v, res: %v, err: %v", trace, res, err)
+	}
+}
+
+func TestNestedFilter(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`{"max": 5, "stores": [
+		{"name": "a", "books": [{"title": "x", "price": 4}, {"title": "y", "price": 12}]},
+		{"name": "b", "books": [{"title": "z", "price": 9}]},
+		{"name": "c", "books": []},
+		{"name": "d", "books": [{"title": "w", "price": 3}]}
+	]}`), &obj)
+
+	tcases := map[string]string{
+		"$.stores[?(@.books[?(@.price < 5)])].name":                  "[a d]",
+		"$.stores[?(@.books[?(@.price > 5 && @.price < 10)])].name":  "[b]",
+		"$.stores[?(@.books[?(@.price < 5)] && @.name != 'a')].name": "[d]",
+		"$.stores[?(@.books[?(@.price > 100)])].name":                "[]",
+	}
+	testGet(t, obj, tcases)
+
+	// nested filters see the document root
+	names, err := MustCompile("$.stores[?(@.books[?(@.price < $.max)])].name").LookupMap(obj)
+	if err != nil || fmt.Sprintf("%v", names) != "map[$.stores[0].name:a $.stores[3].name:d]" {
+		t.Errorf("unexpected LookupMap result: %v, err: %v", names, err)
+	}
+}
+
+func TestSetReport(t *testing.T) {
+	jsonText := `{"book": [{"price": 8.95, "tags": ["a", "b"]}]}`
+	data := map[string]interface{}{}
+	json.Unmarshal([]byte(jsonText), &data)
+
+	changed, err := SetReport(data, "$.book[0].price", 8.95)
+	if err != nil || changed {
+		t.Errorf("setting the current value should report no change, got: %v, err: %v", changed, err)
+	}
+	changed, err = SetReport(data, "$.book[0].tags", []interface{}{"a", "b"})
+	if err != nil || changed {
+		t.Errorf("setting a deep equal value should report no change, got: %v, err: %v", changed, err)
+	}
+
+	changed, err = SetReport(data, "$.book[0].price", 9.5)
+	if err != nil || !changed {
+		t.Errorf("setting a new value should report a change, got: %v, err: %v", changed, err)
+	}
+	res, _ := Get(data, "$.book[0].price")
+	if res.Value() != 9.5 {
+		t.Errorf("exp: 9.5, got: %v", res.Value())
+	}
+
+	changed, err = MustCompile("$.book[0].isbn").SetReport(data, "0-553-21311-3")
+	if err != nil || !changed {
+		t.Errorf("setting a missing key should report a change, got: %v, err: %v", changed, err)
+	}
+
+	_, err = SetReport(data, "$.missing.key", 1)
+	if err == nil {
+		t.Errorf("missing path should raise error")
+	}
+}
+
+func Test_jsonpath_eval_filter_arithmetic(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`{"budget": 20, "base": 8, "tax": 1,
+		"book": [{"title": "a", "price": 8.95}, {"title": "b", "price": 12.99}, {"title": "c", "price": 9}]}`), &obj)
+
+	tcases := map[string]string{
+		"$.book[?(@.price < $.budget * 0.5)].title":     "[a c]",
+		"$.book[?(@.price <= $.base + $.tax)].title":    "[a c]",
+		"$.book[?(@.price > $.base + $.tax * 2)].title": "[b]",
+		"$.book[?(@.price == $.budget / 2 - 1)].title":  "[c]",
+		"$.book[?(@.price > $.budget - @.price)].title": "[b]",
+		// quoted operands are text, not arithmetic
+		"$.book[?(@.title == '1 - 2')].title":       "[]",
+		"$.book[?(@.title contains '1 - 2')].title": "[]",
+		"$.book[?(@.title != '1 - 2')].title":       "[a b c]",
+	}
+	testGet(t, obj, tcases)
+
+	_, err := evalFilter(obj, obj, "@.budget", ">", "$.budget * $.book")
+	if !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("exp ErrTypeMismatch for a non numeric operand, got: %v", err)
+	}
+
+	// extra tokens that don't form arithmetic are still rejected
+	for _, filter := range []string{"@.price > 10 20", "@.price < $.budget and"} {
+		if _, err := parseFilter(filter); err == nil {
+			t.Errorf("filter: %s, exp invalid char error", filter)
+		}
+	}
+}
+
+func TestLookupFirst(t *testing.T) {
+	value, found, err := MustCompile("$..isbn").LookupFirst(json_data)
+	if err != nil || !found || value != "0-553-21311-3" {
+		t.Errorf("exp: 0-553-21311-3, got: %v, %v, err: %v", value, found, err)
+	}
+
+	value, found, err = MustCompile("$.store.book[?(@.price > 10)].title").LookupFirst(json_data)
+	if err != nil || !found || value != "Sword of Honour" {
+		t.Errorf("exp: Sword of Honour, got: %v, %v, err: %v", value, found, err)
+	}
+
+	visited := 0
+	c := MustCompile("$..price")
+	err = c.walk(json_data, func(path string, depth int, v interface{}) error {
+		visited++
+		return errStopWalk
+	})
+	if err != nil || visited != 1 {
+		t.Errorf("walk should stop after the first match, visited: %d, err: %v", visited, err)
+	}
+
+	value, found, err = MustCompile("$..missing").LookupFirst(json_data)
+	if err != nil || found || value != nil {
+		t.Errorf("exp not found, got: %v, %v, err: %v", value, found, err)
+	}
+}
+
+func Test_jsonpath_eval_filter_json_func(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`{"events": [
+		{"type": "a", "payload": "{\"id\": 1, \"user\": {\"name\": \"tom\"}, \"tags\": [\"x\"]}"},
+		{"type": "b", "payload": "{\"id\": 2, \"user\": {\"name\": \"tony\"}, \"tags\": [\"y\"]}"},
+		{"type": "c", "payload": "not json"}
+	]}`), &obj)
+
+	tcases := map[string]string{
+		"$.events[?(json(@.payload).id == 2)].type":            "[b]",
+		"$.events[?(json(@.payload).user.name == 'tom')].type": "[a]",
+		"$.events[?(parse(@.payload).tags[0] == 'y')].type":    "[b]",
+		"$.events[?(json(@.payload).id)].type":                 "[a b]",
+	}
+	testGet(t, obj, tcases)
+
+	events := obj.(map[string]interface{})["events"].([]interface{})
+	_, err := getByPath(events[0], obj, "json(@.type")
+	if err == nil {
+		t.Errorf("unterminated json() should raise error")
+	}
+	_, err = getByPath(map[string]interface{}{"payload": 1}, obj, "json(@.payload).id")
+	if !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("exp ErrTypeMismatch for a non string value, got: %v", err)
+	}
+}
+
+func TestCompiledPathString(t *testing.T) {
+	tcases := map[string]string{
+		"$.store.book[0].title":               "$.store.book[0].title",
+		"$.store.book[0,1].title":             "$.store.book[0,1].title",
+		"$.store.book[1:2]":                   "$.store.book[1:2]",
+		"$.store.book[::-1].author":           "$.store.book[::-1].author",
+		"$.store.book[*].price":               "$.store.book[*].price",
+		"$.store.book[?(@.price > 10)].title": "$.store.book[?(@.price > 10)].title",
+		"$..book[(@.length-1)].title":         "$..book[(@.length-1)].title",
+		"$..price":                            "$..price",
+		"$.store.*":                           "$.store.*",
+		"$[0].name":                           "$[0].name",
+		"$..[0]":                              "$..[0]",
+	}
+	for path, exp := range tcases {
+		c := MustCompile(path)
+		got := c.PathString()
+		if got != exp {
+			t.Errorf("path: %s, exp: %s, got: %s", path, exp, got)
+		}
+		again, err := Compile(got)
+		if err != nil {
+			t.Errorf("path: %s, PathString %s should compile, err: %v", path, got, err)
+			continue
+		}
+		if !reflect.DeepEqual(again.operations, c.operations) {
+			t.Errorf("path: %s, exp: %v, got: %v", path, c.operations, again.operations)
+		}
+	}
+
+	c := MustCompile("$/store/book[0]/title", WithDelimiter('/'))
+	if c.PathString() != "$.store.book[0].title" {
+		t.Errorf("exp: $.store.book[0].title, got: %s", c.PathString())
+	}
+}
+
+func Test_jsonpath_eval_filter_key(t *testing.T) {
+	res, err := Get(json_data, "$.store[?(@key == 'bicycle')].color")
+	t.Log(res, err)
+	if err != nil || fmt.Sprintf("%v", res.Value()) != "[red]" {
+		t.Errorf("exp: [red], got: %v, err: %v", res, err)
+	}
+
+	keys, err := GetMatchingKeys(json_data, "$.store[?(@key != 'book')]")
+	if err != nil || fmt.Sprintf("%v", keys) != "[bicycle]" {
+		t.Errorf("exp: [bicycle], got: %v, err: %v", keys, err)
+	}
+	keys, err = GetMatchingKeys(json_data, "$.store[?(@key =~ /^b/)]")
+	if err != nil || fmt.Sprintf("%v", keys) != "[bicycle book]" {
+		t.Errorf("exp: [bicycle book], got: %v, err: %v", keys, err)
+	}
+
+	paths, err := MustCompile("$.store[?(@key == 'bicycle')].price").LookupMap(json_data)
+	if err != nil || fmt.Sprintf("%v", paths) != "map[$.store.bicycle.price:19.95]" {
+		t.Errorf("unexpected LookupMap result: %v, err: %v", paths, err)
+	}
+
+	// there is no key when filtering an array
+	res, err = Get(json_data, "$.store.book[?(@key == 'book')]")
+	if err != nil || len(res.Value().([]interface{})) != 0 {
+		t.Errorf("exp no match, got: %v, err: %v", res, err)
+	}
+	if _, err := getByPath(json_data, json_data, "@key"); err == nil {
+		t.Errorf("@key outside of a map filter should raise error")
+	}
+}
+
+func TestResultTypedSlice(t *testing.T) {
+	obj := map[string]interface{}{"ids": []int{3, 5, 8}, "empty": []int{}}
+
+	res, err := Get(obj, "$.ids[0:]")
+	t.Log(res, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.First() != 3 || res.Last() != 8 || res.Index(1) != 5 || res.Index(-2) != 5 {
+		t.Errorf("unexpected items of %v: %v %v %v", res.Value(), res.First(), res.Last(), res.Index(1))
+	}
+	if res.Index(3) != nil || res.Index(-4) != nil {
+		t.Errorf("out of range index should be nil")
+	}
+
+	empty := &Result{value: []int{}, isArray: true}
+	if empty.First() != nil || empty.Last() != nil || empty.Index(0) != nil {
+		t.Errorf("empty typed slice should have no items")
+	}
+	null := &Result{isArray: true}
+	if null.First() != nil || null.Last() != nil {
+		t.Errorf("null array result should have no items")
+	}
+
+	res, err = Get(obj, "$.ids[1]")
+	if err != nil || res.First() != 5 || res.Last() != 5 || res.Index(1) != nil {
+		t.Errorf("single value should be its own first and last item, got: %v, err: %v", res, err)
+	}
+}
+
+func TestGetCopy(t *testing.T) {
+	jsonText := `{"book": [{"title": "a", "tags": ["x", "y"]}, {"title": "b", "tags": null}]}`
+	data := map[string]interface{}{}
+	json.Unmarshal([]byte(jsonText), &data)
+
+	res, err := GetCopy(data, "$.book[0]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	book := res.Value().(map[string]interface{})
+	book["title"] = "changed"
+	book["tags"].([]interface{})[0] = "changed"
+
+	orig, _ := Get(data, "$.book[0]")
+	if fmt.Sprintf("%v", orig.Value()) != "map[tags:[x y] title:a]" {
+		t.Errorf("GetCopy result should not share memory with the document, got: %v", orig.Value())
+	}
+
+	res, err = GetCopy(data, "$.book[*].tags")
+	if err != nil || fmt.Sprintf("%v", res.Value()) != "[[x y] <nil>]" {
+		t.Errorf("exp: [[x y] <nil>], got: %v, err: %v", res, err)
+	}
+
+	typed := map[string]interface{}{"ids": map[string][]int{"a": {1, 2}}}
+	res, err = GetCopy(typed, "$.ids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Value().(map[string][]int)["a"][0] = 100
+	if typed["ids"].(map[string][]int)["a"][0] != 1 {
+		t.Errorf("typed maps and slices should be copied too, got: %v", typed)
+	}
+
+	_, err = GetCopy(data, "$.missing")
+	if err == nil {
+		t.Errorf("missing path should raise error")
+	}
+}
+
+func Test_jsonpath_eval_filter_between(t *testing.T) {
+	tcases := map[string]string{
+		"$.store.book[?(@.price between 8.99 and 13)].title":       "[Sword of Honour Moby Dick]",
+		"$.store.book[?(@.price between 9 and 13)].title":          "[Sword of Honour]",
+		"$.store.book[?(@.price between 1 and $.expensive)].price": "[8.95 8.99]",
+		"$.store.book[?(@.price between 20 and 10)].title":         "[]",
+	}
+	testGet(t, json_data, tcases)
+
+	obj := map[string]interface{}{"and": 5, "price": 5}
+	ok, err := evalFilter(obj, obj, "@.price", "between", "@.and and 6")
+	if err != nil || !ok {
+		t.Errorf("`and` as a key should not be confused with the separator, got: %v, err: %v", ok, err)
+	}
+	if _, err := evalFilter(obj, obj, "@.price", "between", "1"); err == nil {
+		t.Errorf("missing upper bound should raise error")
+	}
+}
+
+func Test_jsonpath_eval_filter_root_index(t *testing.T) {
+	res, err := Get(json_data, "$.store.book[?(@.price > $.store.book[0].price)].title")
+	t.Log(res, err)
+	if err != nil || fmt.Sprintf("%v", res.Value()) != "[Sword of Honour Moby Dick The Lord of the Rings]" {
+		t.Errorf("exp books priced above the first one, got: %v, err: %v", res, err)
+	}
+	res, err = Get(json_data, "$.store.book[?(@.price < $.store.book[-1].price)].title")
+	if err != nil || len(res.Value().([]interface{})) != 3 {
+		t.Errorf("exp books cheaper than the last one, got: %v, err: %v", res, err)
+	}
+
+	var obj interface{}
+	json.Unmarshal([]byte(`{"limits": [[1, 5], [10, 20]], "items": [{"n": 3}, {"n": 12}, {"n": 25}]}`), &obj)
+	res, err = Get(obj, "$.items[?(@.n >= $.limits[1][0] && @.n <= $.limits[1][1])].n")
+	t.Log(res, err)
+	if err != nil || fmt.Sprintf("%v", res.Value()) != "[12]" {
+		t.Errorf("exp: [12], got: %v, err: %v", res, err)
+	}
+	paths, err := MustCompile("$.items[?(@.n < $.limits[0][1])].n").LookupMap(obj)
+	if err != nil || fmt.Sprintf("%v", paths) != "map[$.items[0].n:3]" {
+		t.Errorf("unexpected LookupMap result: %v, err: %v", paths, err)
+	}
+}
+
+func TestLookupN(t *testing.T) {
+	c := MustCompile("$.store.book[*].title")
+	tcases := map[int]string{
+		2:  "[Sayings of the Century Sword of Honour]",
+		1:  "[Sayings of the Century]",
+		10: "[Sayings of the Century Sword of Honour Moby Dick The Lord of the Rings]",
+		0:  "[Sayings of the Century Sword of Honour Moby Dick The Lord of the Rings]",
+		-1: "[Sayings of the Century Sword of Honour Moby Dick The Lord of the Rings]",
+	}
+	for n, exp := range tcases {
+		res, err := c.LookupN(json_data, n)
+		if err != nil || fmt.Sprintf("%v", res) != exp {
+			t.Errorf("n: %d, exp: %s, got: %v, err: %v", n, exp, res, err)
+		}
+	}
+
+	res, err := MustCompile("$..missing").LookupN(json_data, 2)
+	if err != nil || len(res) != 0 {
+		t.Errorf("exp no match, got: %v, err: %v", res, err)
+	}
+}
+
+func TestLookupNParity(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`{"arr": [{"k": 1}, null, {"k": 3}]}`), &obj)
+
+	tcases := []struct {
+		obj  interface{}
+		path string
+	}{
+		{obj, "$.arr.k"},
+		{obj, "$.arr[*].k"},
+		{obj, "$.arr[0,1].k"},
+		{json_data, "$.store.book[*].price"},
+		{json_data, "$.store.book.author"},
+		{json_data, "$..price"},
+		{json_data, "$.store.book[?(@.price > 10)].title"},
+	}
+	for _, tcase := range tcases {
+		c := MustCompile(tcase.path)
+		res, isArray, err := c.Lookup(tcase.obj)
+		if err != nil {
+			t.Fatalf("path: %s, err: %v", tcase.path, err)
+		}
+		exp, ok := res.([]interface{})
+		if !isArray || !ok {
+			exp = []interface{}{res}
+		}
+
+		all, err := c.LookupN(tcase.obj, 0)
+		if err != nil || !reflect.DeepEqual(all, exp) {
+			t.Errorf("path: %s, LookupN exp: %v, got: %v, err: %v", tcase.path, exp, all, err)
+		}
+		first2, err := c.LookupN(tcase.obj, 2)
+		if err != nil || !reflect.DeepEqual(first2, exp[:2]) {
+			t.Errorf("path: %s, LookupN(2) exp: %v, got: %v, err: %v", tcase.path, exp[:2], first2, err)
+		}
+		first, found, err := c.LookupFirst(tcase.obj)
+		if err != nil || !found || !reflect.DeepEqual(first, exp[0]) {
+			t.Errorf("path: %s, LookupFirst exp: %v, got: %v, err: %v", tcase.path, exp[0], first, err)
+		}
+		matches, err := c.LookupAllPaths(tcase.obj)
+		values := make([]interface{}, 0, len(matches))
+		for _, m := range matches {
+			values = append(values, m.Value)
+		}
+		if err != nil || !reflect.DeepEqual(values, exp) {
+			t.Errorf("path: %s, LookupAllPaths exp: %v, got: %v, err: %v", tcase.path, exp, values, err)
+		}
+	}
+
+	// the implicit descent Lookup refuses fails the others too
+	c := MustCompile("$.arr.k", DisallowImplicitDescent())
+	if _, _, err := c.Lookup(obj); err == nil {
+		t.Fatalf("exp Lookup to fail")
+	}
+	if res, err := c.LookupN(obj, 1); err == nil {
+		t.Errorf("exp LookupN to fail, got: %v", res)
+	}
+	if res, _, err := c.LookupFirst(obj); err == nil {
+		t.Errorf("exp LookupFirst to fail, got: %v", res)
+	}
+	if res, err := c.LookupAllPaths(obj); err == nil {
+		t.Errorf("exp LookupAllPaths to fail, got: %v", res)
+	}
+}
+
+func Test_jsonpath_rootnode_is_scalar(t *testing.T) {
+	tcases := []interface{}{42.0, "hello", true, nil, map[string]interface{}{"a": 1}, []interface{}{1, 2}}
+	for _, obj := range tcases {
+		res, err := Get(obj, "$")
+		if err != nil || !reflect.DeepEqual(res.Value(), obj) {
+			t.Errorf("exp: %v, got: %v, err: %v", obj, res, err)
+		}
+	}
+
+	if _, err := Get(42.0, "$.a"); err == nil {
+		t.Errorf("key of a scalar root should raise error")
+	}
+}
+
+func TestImplicitArrayDescent(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`{
+		"a": [{"b": {"c": 1}, "t": [1, 2]}, {"b": {"c": 2}, "t": [3]}, {"x": 0}],
+		"m": [[{"x": 1}], [{"x": 2}, {"x": 3}]],
+		"n": [[[{"x": 1}]], {"x": 2}],
+		"d": [{"f": [{"n": "x"}, {"n": "y"}]}, {"f": [{"n": "z"}]}]
+	}`), &obj)
+
+	tcases := []struct {
+		obj  interface{}
+		path string
+		exp  string
+	}{
+		{json_data, "$.store.book.author", "[Nigel Rees Evelyn Waugh Herman Melville J. R. R. Tolkien]"},
+		{obj, "$.a.b.c", "[1 2]"},
+		{obj, "$.a.t", "[[1 2] [3]]"},
+		// a key flattens exactly one level: nested arrays keep their shape
+		{obj, "$.m.x", "[[1] [2 3]]"},
+		{obj, "$.n.x", "[[[1]] 2]"},
+		// each key of a chain flattens its own level
+		{obj, "$.d.f.n", "[x y z]"},
+	}
+	for _, tcase := range tcases {
+		res, err := Get(tcase.obj, tcase.path)
+		if err != nil || fmt.Sprintf("%v", res.Value()) != tcase.exp {
+			t.Errorf("Get path: %s, exp: %s, got: %v, err: %v", tcase.path, tcase.exp, res, err)
+		}
+		value, err := MustCompile(tcase.path)._Lookup(tcase.obj)
+		if err != nil || fmt.Sprintf("%v", value) != tcase.exp {
+			t.Errorf("_Lookup path: %s, exp: %s, got: %v, err: %v", tcase.path, tcase.exp, value, err)
+		}
+	}
+
+	res, _ := Get(json_data, "$.store.book.author")
+	if authors := res.Value().([]interface{}); len(authors) != 4 {
+		t.Errorf("exp a flat array of 4 authors, got: %v", authors)
+	}
+}
+
+func TestNumbersAsFloat64(t *testing.T) {
+	decode := func(text string) map[string]interface{} {
+		data := map[string]interface{}{}
+		json.Unmarshal([]byte(text), &data)
+		return data
+	}
+
+	// the package has no Diff, reflect.DeepEqual against the decoded document
+	// stands in for it to detect spurious changes
+	data := decode(`{"count": 1, "sizes": []}`)
+	Set(data, "$.count", 5)
+	if reflect.DeepEqual(data, decode(`{"count": 5, "sizes": []}`)) {
+		t.Errorf("int should be stored as is by default")
+	}
+
+	data = decode(`{"count": 1, "sizes": []}`)
+	Set(data, "$.count", 5, NumbersAsFloat64())
+	Set(data, "$.sizes", []interface{}{1, int64(2), float32(2.5), "3"}, NumbersAsFloat64())
+	if exp := decode(`{"count": 5, "sizes": [1, 2, 2.5, "3"]}`); !reflect.DeepEqual(data, exp) {
+		t.Errorf("exp: %v, got: %v", exp, data)
+	}
+	changed, err := SetReport(data, "$.count", 5, NumbersAsFloat64())
+	if err != nil || changed {
+		t.Errorf("setting an equal int should report no change, got: %v, err: %v", changed, err)
+	}
+
+	if v := NormalizeNumbers(json.Number("12")); v != 12.0 {
+		t.Errorf("exp: 12, got: %#v", v)
+	}
+	if v := NormalizeNumbers(map[string]interface{}{"a": []interface{}{uint8(1)}}); fmt.Sprintf("%#v", v) != `map[string]interface {}{"a":[]interface {}{1}}` {
+		t.Errorf("exp nested numbers to be float64, got: %#v", v)
+	}
+}
+
+func TestValidatePath(t *testing.T) {
+	valid := []string{
+		"$",
+		"$.store.book[0].title",
+		"$..book[?(@.price > 10 && @.category == 'fiction')].title",
+		"$.store.book[?(@.title =~ /\\(.*\\]/)]",
+		"$.store.book[?(@.title == 'a (b')]",
+		"$.store.book[?(@.price between 8 and 13)]",
+		"$.store.book[(@.length-1)]",
+	}
+	for _, path := range valid {
+		if err := ValidatePath(path); err != nil {
+			t.Errorf("path: %s, should be valid, got: %v", path, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"store",
+		"$.store.book[0",
+		"$.store.book[?(@.price > 10]",
+		"$.store.book[?(@.price >> 10)]",
+		"$.store.book[?(@.price like 10)]",
+		"$.store.book[1:2:0]",
+		"$.store.book[?(@.title == 'a)]",
+	}
+	for _, path := range invalid {
+		err := ValidatePath(path)
+		t.Log(path, err)
+		if !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("path: %s, exp ErrInvalidPath, got: %v", path, err)
+		}
+	}
+}
+
+func TestFilterWildcardPath(t *testing.T) {
+	data := dogsData()
+
+	tcases := map[string]string{
+		"$.dogs[?(@.friends[*].name contains 'Alice')].name":   "[Tom]",
+		"$.dogs[?(@.friends[*].name contains 'David')].name":   "[Tom Tony]",
+		"$.dogs[?(@.friends[1:].name contains 'Alice')].name":  "[]",
+		"$.dogs[?(@.friends[0:1].name contains 'Alice')].name": "[Tom]",
+	}
+	testGet(t, data, tcases)
+
+	res, err := filterGetFromExplicitPath(data, "$.dogs[*].friends[*].age")
+	t.Log(res, err)
+	if err != nil || fmt.Sprintf("%v", res) != "[10 9 9 9]" {
+		t.Errorf("exp: [10 9 9 9], got: %v, err: %v", res, err)
+	}
+}
+
+func TestGetAllWithDepth(t *testing.T) {
+	matches, err := GetAllWithDepth(json_data, "$..price")
+	t.Log(matches, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []DepthMatch{
+		{Path: "$.store.bicycle.price", Depth: 2, Value: 19.95},
+		{Path: "$.store.book[0].price", Depth: 3, Value: 8.95},
+		{Path: "$.store.book[1].price", Depth: 3, Value: 12.99},
+		{Path: "$.store.book[2].price", Depth: 3, Value: 8.99},
+		{Path: "$.store.book[3].price", Depth: 3, Value: 22.99},
+	}
+	if !reflect.DeepEqual(matches, exp) {
+		t.Errorf("exp: %v, got: %v", exp, matches)
+	}
+
+	matches, err = GetAllWithDepth(json_data, "$.expensive")
+	if err != nil || len(matches) != 1 || matches[0].Depth != 0 {
+		t.Errorf("exp a match at depth 0, got: %v, err: %v", matches, err)
+	}
+	if _, err := GetAllWithDepth(json_data, "$.store["); err == nil {
+		t.Errorf("invalid path should raise error")
+	}
+}
+
+func Test_jsonpath_eval_filter_missing_operand(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`{"items": [
+		{"name": "a", "price": 10, "sale": 12},
+		{"name": "b", "price": 10},
+		{"name": "c", "price": 10, "sale": 8},
+		{"name": "d", "sale": 9}
+	]}`), &obj)
+
+	tcases := map[string]string{
+		"$.items[?(@.sale > @.price)].name":    "[a]",
+		"$.items[?(@.sale < @.price)].name":    "[c]",
+		"$.items[?(@.sale != @.price)].name":   "[a c]",
+		"$.items[?(@.sale)].name":              "[a c d]",
+		"$.items[?(@.sale >= $.missing)].name": "[]",
+	}
+	testGet(t, obj, tcases)
+
+	item := map[string]interface{}{"price": 10}
+	ok, err := evalFilter(item, item, "@.sale", ">", "@.price")
+	if ok || err != nil {
+		t.Errorf("missing operand should be a non-match without error, got: %v, err: %v", ok, err)
+	}
+	ok, err = evalFilter(item, item, "@.price", "<", "@.sale.amount")
+	if ok || err != nil {
+		t.Errorf("missing operand should be a non-match without error, got: %v, err: %v", ok, err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	var dst, src map[string]interface{}
+	json.Unmarshal([]byte(`{"a": 1, "b": {"c": 2, "d": [1, 2]}, "e": "x", "f": {}}`), &dst)
+	json.Unmarshal([]byte(`{"b": {"c": 3, "d": [3], "g": {"h": true}}, "e": {"i": 4}, "f": {}, "j.k": null}`), &src)
+
+	// conflicts are found before anything is written
+	before := deepCopy(dst)
+	if err := Merge(dst, src, WithDuplicatePolicy(DuplicateError)); err == nil {
+		t.Errorf("$.e.i should conflict with $.e")
+	}
+	if !reflect.DeepEqual(dst, before) {
+		t.Errorf("dst should be untouched on error, got: %v", dst)
+	}
+
+	err := Merge(dst, src)
+	t.Log(dst, err)
+	var exp map[string]interface{}
+	json.Unmarshal([]byte(`{"a": 1, "b": {"c": 3, "d": [3], "g": {"h": true}}, "e": {"i": 4}, "f": {}, "j.k": null}`), &exp)
+	if err != nil || !reflect.DeepEqual(dst, exp) {
+		t.Errorf("exp: %v, got: %v, err: %v", exp, dst, err)
+	}
+
+	err = Merge(dst, map[string]interface{}{"b": map[string]interface{}{"d": []interface{}{4.0}}}, WithArrayMerge(ArrayAppend))
+	d := dst["b"].(map[string]interface{})["d"]
+	t.Log(d, err)
+	if err != nil || !reflect.DeepEqual(d, []interface{}{3.0, 4.0}) {
+		t.Errorf("exp: [3 4], got: %v, err: %v", d, err)
+	}
+
+	if err := Merge([]interface{}{}, src); err != NotMap {
+		t.Errorf("exp: NotMap, got: %v", err)
+	}
+}
+
+func Test_jsonpath_eval_filter_bytes(t *testing.T) {
+	data := []interface{}{
+		map[string]interface{}{"name": []byte("Tony"), "id": 1},
+		map[string]interface{}{"name": []byte("Alice"), "id": 2},
+		map[string]interface{}{"name": "Tom", "id": 3},
+	}
+	tcases := map[string]string{
+		"$[?(@.name =~ /^To/)].id":   "[1 3]",
+		"$[?(@.name == 'Alice')].id": "[2]",
+		"$[?(@.name > 'B')].id":      "[1 3]",
+	}
+	testGet(t, data, tcases)
+}
+
+func TestDisallowScan(t *testing.T) {
+	for _, path := range []string{"$..author", "$.store..price", "$.store.*"} {
+		_, err := Compile(path, DisallowScan())
+		t.Log(path, err)
+		if !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("%s should not compile, got: %v", path, err)
+		}
+	}
+
+	c, err := Compile("$.store.book[*].author", DisallowScan())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := c.Lookup(json_data)
+	if err != nil || len(res.([]interface{})) != 4 {
+		t.Errorf("exp 4 authors, got: %v, err: %v", res, err)
+	}
+}
+
+func TestDisallowImplicitDescent(t *testing.T) {
+	for _, path := range []string{"$.store.book.price", "$.store.book.author"} {
+		c, err := Compile(path, DisallowImplicitDescent())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, _, err := c.Lookup(json_data)
+		t.Log(path, err)
+		if err == nil || !strings.Contains(err.Error(), "expected object, got array") {
+			t.Errorf("%s should fail, got: %v, err: %v", path, res, err)
+		}
+
+		// the default stays lenient
+		res, _, err = MustCompile(path).Lookup(json_data)
+		if err != nil || len(res.([]interface{})) != 4 {
+			t.Errorf("%s: exp 4 results, got: %v, err: %v", path, res, err)
+		}
+	}
+
+	tcases := map[string]string{
+		"$.store.book[*].price":              "[8.95 12.99 8.99 22.99]",
+		"$.store.book[0].price":              "8.95",
+		"$.store.book[0,1].price":            "[8.95 12.99]",
+		"$.store.book[1:2].price":            "[12.99 8.99]",
+		"$.store.book[?(@.price < 9)].price": "[8.95 8.99]",
+	}
+	for path, exp := range tcases {
+		c, err := Compile(path, DisallowImplicitDescent())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, _, err := c.Lookup(json_data)
+		if err != nil || fmt.Sprint(res) != exp {
+			t.Errorf("%s: exp %s, got: %v, err: %v", path, exp, res, err)
+		}
+	}
+
+	// walking skips the implicit descent instead of failing
+	path, err := MustCompile("$.store.book.price", DisallowImplicitDescent()).Reverse(json_data)
+	if err == nil {
+		t.Errorf("exp no match, got: %v", path)
+	}
+}
+
+func Test_jsonpath_eval_filter_coercion(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`[
+		{"id": "01", "price": "12.5"},
+		{"id": "1", "price": 9},
+		{"id": 1, "price": "abc"}
+	]`), &obj)
+
+	tcases := map[string]string{
+		"$[?(num(@.price) > 10)].id":   "[01]",
+		"$[?(num(@.price) > '10')].id": "[01]",
+		"$[?(num(@.price) < 10)].id":   "[1]",
+		"$[?(str(@.id) == '01')].id":   "[01]",
+		"$[?(str(@.id) == 1)].id":      "[1 1]",
+		"$[?(@.id == 1)].id":           "[01 1 1]",
+		"$[?(str(@.id) =~ /^0/)].id":   "[01]",
+	}
+	testGet(t, obj, tcases)
+}
+
+func TestResultGet(t *testing.T) {
+	store, err := Get(json_data, "$.store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := store.Get("$.book[0].title")
+	t.Log(res, err)
+	if err != nil || res.Value() != "Sayings of the Century" {
+		t.Errorf("exp: Sayings of the Century, got: %v, err: %v", res, err)
+	}
+	res, err = store.Get("@.bicycle.color")
+	if err != nil || res.Value() != "red" {
+		t.Errorf("exp: red, got: %v, err: %v", res, err)
+	}
+
+	books, _ := store.Get("$.book[?(@.price < 10)]")
+	res, err = books.Get("$.author")
+	t.Log(res, err)
+	if err != nil || fmt.Sprintf("%v", res.Value()) != "[Nigel Rees Herman Melville]" {
+		t.Errorf("exp: [Nigel Rees Herman Melville], got: %v, err: %v", res, err)
+	}
+	res, err = books.Get("$[1].price")
+	if err != nil || res.Value() != 8.99 {
+		t.Errorf("exp: 8.99, got: %v, err: %v", res, err)
+	}
+
+	if _, err := store.Get("$.missing"); err == nil {
+		t.Errorf("missing key should fail")
+	}
+}
+
+func Test_jsonpath_get_range_mixed_sign(t *testing.T) {
+	obj := []interface{}{"a", "b", "c", "d", "e"}
+	// bounds are inclusive and negative bounds count from the end
+	tcases := map[string]string{
+		"$[-3:4]":  "[c d e]",
+		"$[-3:3]":  "[c d]",
+		"$[-2:]":   "[d e]",
+		"$[1:-1]":  "[b c d e]",
+		"$[1:-2]":  "[b c d]",
+		"$[-5:-4]": "[a b]",
+		"$[2:-1]":  "[c d e]",
+	}
+	testGet(t, obj, tcases)
+}
+
+func TestLookupInto(t *testing.T) {
+	type Book struct {
+		Category string  `json:"category"`
+		Author   string  `json:"author"`
+		Title    string  `json:"title"`
+		Price    float64 `json:"price"`
+	}
+	c := MustCompile("$.store.book[0]")
+	var book Book
+	err := c.LookupInto(json_data, &book)
+	t.Log(book, err)
+	exp := Book{Category: "reference", Author: "Nigel Rees", Title: "Sayings of the Century", Price: 8.95}
+	if err != nil || book != exp {
+		t.Errorf("exp: %v, got: %v, err: %v", exp, book, err)
+	}
+
+	var prices []float64
+	err = MustCompile("$.store.book[*].price").LookupInto(json_data, &prices)
+	if err != nil || len(prices) != 4 || prices[3] != 22.99 {
+		t.Errorf("exp 4 prices, got: %v, err: %v", prices, err)
+	}
+
+	if err := MustCompile("$.store.book[0].title").LookupInto(json_data, &book); err == nil {
+		t.Errorf("decoding a string into a struct should fail")
+	}
+}
+
+func Test_jsonpath_eval_filter_nested_exists(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`{"items": [
+		{"name": "a", "config": {"enabled": true}},
+		{"name": "b", "config": {}},
+		{"name": "c"},
+		{"name": "d", "config": "off"},
+		{"name": "e", "config": {"enabled": false}},
+		{"name": "f", "config": null}
+	]}`), &obj)
+
+	tcases := map[string]string{
+		"$.items[?(@.config.enabled)].name":         "[a e]",
+		"$.items[?(@.config.enabled == true)].name": "[a]",
+		"$.items[?(@.config)].name":                 "[a b d e]",
+	}
+	testGet(t, obj, tcases)
+}
+
+func TestCompiledReverse(t *testing.T) {
+	data := deepCopy(json_data)
+	c := MustCompile("$.store.book[?(@.author == 'Herman Melville')]")
+	path, err := c.Reverse(data)
+	t.Log(path, err)
+	if err != nil || path != "$.store.book[2]" {
+		t.Fatalf("exp: $.store.book[2], got: %v, err: %v", path, err)
+	}
+	if err := Set(data, path+".price", 5.0); err != nil {
+		t.Fatal(err)
+	}
+	res, _ := Get(data, "$.store.book[?(@.author == 'Herman Melville')].price")
+	if fmt.Sprintf("%v", res.Value()) != "[5]" {
+		t.Errorf("exp: [5], got: %v", res.Value())
+	}
+
+	if _, err := MustCompile("$.store.book[?(@.price < 10)]").Reverse(data); err == nil {
+		t.Errorf("several matches should fail")
+	}
+	if _, err := MustCompile("$.store.book[?(@.price > 100)]").Reverse(data); err == nil {
+		t.Errorf("no match should fail")
+	}
+}
+
+func TestPathSet(t *testing.T) {
+	set, err := NewPathSet(
+		"$.store.book[?(@.price < 10)].price",
+		"$.store.bicycle.color",
+		"$.store.book[3].title",
+		"$.store.bicycle.color",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcases := map[string]bool{
+		"$.store.book[0].price":  true,
+		"$.store.book[2].price":  true,
+		"$.store.book[1].price":  false,
+		"$.store.book[-1].title": true,
+		"$.store.book[-2].price": true,
+		"$.store.book[9].title":  false,
+		"$.store.book[3].title":  true,
+		"$.store.bicycle.price":  false,
+		"$.store.[":              false,
+	}
+	for path, exp := range tcases {
+		if got := set.Contains(json_data, path); got != exp {
+			t.Errorf("%s exp: %v, got: %v", path, exp, got)
+		}
+	}
+
+	exp := []string{"$.store.bicycle.color", "$.store.book[0].price", "$.store.book[2].price", "$.store.book[3].title"}
+	if got := set.Matches(json_data); !reflect.DeepEqual(got, exp) {
+		t.Errorf("exp: %v, got: %v", exp, got)
+	}
+
+	if _, err := NewPathSet("$.a", "$.b["); err == nil {
+		t.Errorf("invalid path should fail")
+	}
+}
+
+func Test_jsonpath_eval_filter_affix(t *testing.T) {
+	tcases := map[string]string{
+		"$.store.book[?(@.title ^= 'The')].title":      "[The Lord of the Rings]",
+		"$.store.book[?(@.title $= 'Rings')].title":    "[The Lord of the Rings]",
+		"$.store.book[?(@.title $= 'rings')].title":    "[]",
+		"$.store.book[?(@.author ^= 'J. R.')].title":   "[The Lord of the Rings]",
+		"$.store.book[?(@.price ^= '8')].title":        "[]",
+		"$.store.book[?(@.category $= 'tion')].author": "[Evelyn Waugh Herman Melville J. R. R. Tolkien]",
+	}
+	testGet(t, json_data, tcases)
+	if err := ValidatePath("$.store.book[?(@.title ^= 'The')]"); err != nil {
+		t.Errorf("^= should be valid, got: %v", err)
+	}
+}
+
+func TestCompiledLookupAllocs(t *testing.T) {
+	c := MustCompile("$.store.book[0].price")
+	for i := 0; i < 3; i++ {
+		res, _, err := c.Lookup(json_data)
+		if err != nil || res != 8.95 {
+			t.Fatalf("lookup %d exp: 8.95, got: %v, err: %v", i, res, err)
+		}
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		c.Lookup(json_data)
+	})
+	if allocs != 0 {
+		t.Errorf("exp no allocation, got: %v", allocs)
+	}
+}
+
+func TestCompiledLookupConcurrent(t *testing.T) {
+	// run with -race: lookups of one Compiled don't share any state
+	tcases := map[string]string{
+		"$.store.book[0].price":               "8.95",
+		"$.store.book[?(@.price > 10)].title": "[Sword of Honour The Lord of the Rings]",
+		"$.store.book.author":                 "[Nigel Rees Evelyn Waugh Herman Melville J. R. R. Tolkien]",
+		"$.store.book[*].price":               "[8.95 12.99 8.99 22.99]",
+		"$.store.book[-1:].isbn":              "[0-395-19395-8]",
+		"$.store..price":                      "[19.95 8.95 12.99 8.99 22.99]",
+	}
+	for path, exp := range tcases {
+		c := MustCompile(path)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, _, err := c.Lookup(json_data)
+				if err != nil || fmt.Sprintf("%v", res) != exp {
+					t.Errorf("path: %s, exp: %s, got: %v, err: %v", path, exp, res, err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func BenchmarkCompiledLookupAllocs(b *testing.B) {
+	c := MustCompile("$.store.book[0].price")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.Lookup(json_data)
+	}
+}
+
+func BenchmarkGetAllocs(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Get(json_data, "$.store.book[0].price")
+	}
+}
+
+func BenchmarkGetFilterAllocs(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Get(json_data, "$.store.book[?(@.price < 10)].price")
+	}
+}
+
+func Test_jsonpath_eval_filter_nested_index(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`{"items": [
+		{"id": 1, "matrix": [[1, 2], [3, 4]]},
+		{"id": 2, "matrix": [[0, 5], [6, 7]]},
+		{"id": 3, "matrix": []},
+		{"id": 4, "matrix": [[[8]]]}
+	]}`), &obj)
+
+	tcases := map[string]string{
+		"$.items[?(@.matrix[0][0] > 0)].id":     "[1]",
+		"$.items[?(@.matrix[1][1] == 7)].id":    "[2]",
+		"$.items[?(@.matrix[-1][0] > 2)].id":    "[1 2]",
+		"$.items[?(@.matrix[0][0][0] == 8)].id": "[4]",
+	}
+	testGet(t, obj, tcases)
+}
+
+func TestWithDuplicatePolicy(t *testing.T) {
+	pairs := map[string]interface{}{
+		"$.a":     1.0,
+		"$.a.b":   2.0,
+		"$.c[0]":  3.0,
+		"$['c']":  "c",
+		"$.d[0]":  4.0,
+		"$.d.e":   5.0,
+		"$.f.g":   6.0,
+		"$['f']":  nil,
+		"$.h":     7.0,
+		"$['h']":  8.0,
+		"$.i.j.k": 9.0,
+	}
+	tcases := []struct {
+		policy DuplicatePathPolicy
+		exp    string
+	}{
+		{DuplicateFirstWins, `{"a":1,"c":[3],"d":{"e":5},"f":{"g":6},"h":7,"i":{"j":{"k":9}}}`},
+		{DuplicateLastWins, `{"a":{"b":2},"c":"c","d":[4],"f":null,"h":8,"i":{"j":{"k":9}}}`},
+	}
+	for _, tcase := range tcases {
+		res, err := Unflatten(pairs, WithDuplicatePolicy(tcase.policy))
+		data, _ := json.Marshal(res)
+		t.Log(string(data), err)
+		if err != nil || string(data) != tcase.exp {
+			t.Errorf("policy %d exp: %s, got: %s, err: %v", tcase.policy, tcase.exp, data, err)
+		}
+	}
+	if _, err := Unflatten(pairs); err == nil {
+		t.Errorf("conflicting paths should fail")
+	}
+
+	for policy, exp := range map[DuplicatePathPolicy]string{
+		DuplicateFirstWins: `{"a":"x","b":[1],"c":{"d":1}}`,
+		DuplicateLastWins:  `{"a":{"y":2},"b":{"z":3},"c":[]}`,
+	} {
+		dst := map[string]interface{}{"a": "x", "b": []interface{}{1.0}, "c": map[string]interface{}{"d": 1.0}}
+		src := map[string]interface{}{"a": map[string]interface{}{"y": 2.0}, "b": map[string]interface{}{"z": 3.0}, "c": []interface{}{}}
+		err := Merge(dst, src, WithDuplicatePolicy(policy))
+		data, _ := json.Marshal(dst)
+		t.Log(string(data), err)
+		if err != nil || string(data) != exp {
+			t.Errorf("policy %d exp: %s, got: %s, err: %v", policy, exp, data, err)
+		}
+	}
+}
+
+func Test_jsonpath_eval_filter_time(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`{"events": [
+		{"id": 1, "ts": 1640995200},
+		{"id": 2, "ts": "2023-06-01T12:00:00Z"},
+		{"id": 3, "ts": 1704067200.5},
+		{"id": 4, "ts": "2022-12-31T23:59:59+08:00"},
+		{"id": 5, "ts": "yesterday"},
+		{"id": 6}
+	], "since": "2023-01-01T00:00:00Z"}`), &obj)
+
+	tcases := map[string]string{
+		"$.events[?(time(@.ts) > time('2023-01-01'))].id":            "[2 3]",
+		"$.events[?(time(@.ts) < time('2023-01-01'))].id":            "[1 4]",
+		"$.events[?(time(@.ts) >= time($.since))].id":                "[2 3]",
+		"$.events[?(time(@.ts) == time('2022-01-01T00:00:00Z'))].id": "[1]",
+		"$.events[?(time(@.ts) > '2023-06-01')].id":                  "[2 3]",
+		"$.events[?(time(@.ts) < time('2023-06-01 12:00'))].id":      "[]",
+	}
+	testGet(t, obj, tcases)
+}
+
+func Test_jsonpath_eval_filter_paren_literal(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`[{"id": 1, "t": "a (b"}, {"id": 2, "t": "a"}, {"id": 3, "t": "(x)"}]`), &obj)
+
+	tcases := map[string]string{
+		"$[?(@.t == 'a (b')].id":               "[1]",
+		"$[?(@.t != 'a (b')].id":               "[2 3]",
+		"$[?(@.t == '(x)')].id":                "[3]",
+		"$[?(lower(@.t) == 'a (b')].id":        "[1]",
+		"$[?(coalesce(@.t, 'x (') == 'a')].id": "[2]",
+	}
+	testGet(t, obj, tcases)
+}
+
+func TestResultScalars(t *testing.T) {
+	res, _ := Get(json_data, "$.expensive")
+	if f, err := res.Float64(); err != nil || f != 10 {
+		t.Errorf("exp: 10, got: %v, err: %v", f, err)
+	}
+	if i, err := res.Int64(); err != nil || i != 10 {
+		t.Errorf("exp: 10, got: %v, err: %v", i, err)
+	}
+	if _, err := res.String(); err == nil {
+		t.Errorf("a number is not a string")
+	}
+
+	res, _ = Get(json_data, "$.store.bicycle.color")
+	if s, err := res.String(); err != nil || s != "red" {
+		t.Errorf("exp: red, got: %v, err: %v", s, err)
+	}
+	if _, err := res.Float64(); err == nil {
+		t.Errorf("a string is not a number")
+	}
+	if _, err := res.Bool(); err == nil {
+		t.Errorf("a string is not a bool")
+	}
+
+	res, _ = Get(map[string]interface{}{"ok": true}, "$.ok")
+	if b, err := res.Bool(); err != nil || !b {
+		t.Errorf("exp: true, got: %v, err: %v", b, err)
+	}
+
+	res, _ = Get(json_data, "$.store.bicycle.price")
+	if _, err := res.Int64(); err == nil {
+		t.Errorf("19.95 is not an int64")
+	}
+
+	res, _ = Get(json_data, "$.store.book[0:1].price")
+	if _, err := res.Float64(); err == nil {
+		t.Errorf("an array result is not a scalar")
+	}
+}
+
+func Test_jsonpath_eval_filter_empty(t *testing.T) {
+	for _, path := range []string{"$.store.book[?()]", "$.store.book[?( )]"} {
+		res, err := Get(json_data, path)
+		t.Log(path, res, err)
+		if err != nil || len(res.Value().([]interface{})) != 4 {
+			t.Errorf("path: %s, exp 4 books, got: %v, err: %v", path, res, err)
+		}
+	}
+	res, err := Get(json_data, "$.store.book[?()].price")
+	if err != nil || fmt.Sprintf("%v", res.Value()) != "[8.95 12.99 8.99 22.99]" {
+		t.Errorf("exp all prices, got: %v, err: %v", res, err)
+	}
+	matches, err := MustCompile("$.store.book[?()].title").LookupMap(json_data)
+	if err != nil || len(matches) != 4 {
+		t.Errorf("exp 4 titles, got: %v, err: %v", matches, err)
+	}
+}
+
+func TestPathBuilder(t *testing.T) {
+	path, err := NewPath().Key("store").Key("book").Index(0).Key("title").Build()
+	if err != nil || path != "$.store.book[0].title" {
+		t.Fatalf("exp: $.store.book[0].title, got: %s, err: %v", path, err)
+	}
+	res, err := Get(json_data, path)
+	if err != nil || res.Value() != "Sayings of the Century" {
+		t.Errorf("exp: Sayings of the Century, got: %v, err: %v", res, err)
+	}
+
+	tcases := []struct {
+		builder *PathBuilder
+		path    string
+		exp     string
+	}{
+		{NewPath().Key("store").Key("book").Filter("@.price < 10").Key("author"), "$.store.book[?(@.price < 10)].author", "[Nigel Rees Herman Melville]"},
+		{NewPath().Key("store").Key("book").Range(1, 2).Key("price"), "$.store.book[1:2].price", "[12.99 8.99]"},
+		{NewPath().Key("store").Key("book").Wildcard().Key("price"), "$.store.book[*].price", "[8.95 12.99 8.99 22.99]"},
+		{NewPath().Key("a.b").Key("it's").Key("x]y").Key(""), `$['a.b']['it\'s']['x]y']['']`, "1"},
+	}
+	data := map[string]interface{}{"a.b": map[string]interface{}{"it's": map[string]interface{}{"x]y": map[string]interface{}{"": 1}}}}
+	for _, tcase := range tcases {
+		path, err := tcase.builder.Build()
+		if err != nil || path != tcase.path {
+			t.Errorf("exp: %s, got: %s, err: %v", tcase.path, path, err)
+			continue
+		}
+		obj := json_data
+		if strings.HasPrefix(path, "$[") {
+			obj = data
+		}
+		res, err := Get(obj, path)
+		t.Log(path, res, err)
+		if err != nil || fmt.Sprintf("%v", res.Value()) != tcase.exp {
+			t.Errorf("path: %s, exp: %s, got: %v, err: %v", path, tcase.exp, res, err)
+		}
+		if c := MustCompile(path); c.PathString() != path {
+			t.Errorf("exp: %s, got: %s", path, c.PathString())
+		}
+	}
+
+	if _, err := NewPath().Key("store").Filter("@.price ~ 10").Build(); !errors.Is(err, ErrInvalidPath) {
+		t.Errorf("exp: ErrInvalidPath, got: %v", err)
+	}
+}
+
+func Test_jsonpath_eval_filter_pointers(t *testing.T) {
+	type pet struct {
+		Name   string   `json:"name"`
+		Age    *int     `json:"age"`
+		Weight *float64 `json:"weight"`
+		Tag    *string  `json:"tag"`
+	}
+	three, nine := 3, 9
+	weight, tag := 4.5, "vip"
+	data := map[string]interface{}{
+		"pets": []interface{}{
+			pet{Name: "a", Age: &three},
+			&pet{Name: "b", Age: &nine, Weight: &weight, Tag: &tag},
+			pet{Name: "c"},
+			map[string]interface{}{"name": "d", "age": &nine},
+		},
+	}
+	names := func(values interface{}) string {
+		res := make([]string, 0)
+		for _, v := range values.([]interface{}) {
+			name, _ := filterGetFromExplicitPath(v, "@.name")
+			res = append(res, fmt.Sprintf("%v", name))
+		}
+		return strings.Join(res, " ")
+	}
+	tcases := map[string]string{
+		"$.pets[?(@.age > 5)]":      "b d",
+		"$.pets[?(@.age == 3)]":     "a",
+		"$.pets[?(@.age)]":          "a b d",
+		"$.pets[?(@.weight < 5)]":   "b",
+		"$.pets[?(@.tag == 'vip')]": "b",
+		"$.pets[?(@.tag =~ /^v/)]":  "b",
+		"$.pets[?(@.age <= 9)]":     "a b d",
+	}
+	for path, exp := range tcases {
+		res, err := Get(data, path)
+		t.Log(path, res, err)
+		if err != nil || names(res.Value()) != exp {
+			t.Errorf("path: %s, exp: %s, got: %v, err: %v", path, exp, res, err)
+		}
+	}
+}
+
+func TestLookupStrict(t *testing.T) {
+	failures := []string{
+		"$.store.book.isbn",
+		"$.store.missing.title",
+		"$.store.book[10]",
+		"$.expensive.value",
+		"$.store.book[?(@.price > $.store.book)]",
+		"$.store.book[?(@.price =~ /8/)]",
+	}
+	for _, path := range failures {
+		c := MustCompile(path)
+		res, err := c.LookupStrict(json_data)
+		t.Log(path, res, err)
+		if err == nil {
+			t.Errorf("%s should fail, got: %v", path, res)
+		}
+	}
+
+	empties := []string{
+		"$.store.book[?(@.price > 100)]",
+		"$.store.book[?(@.isbn == 'none')]",
+		"$.store.book[?(@.missing)].title",
+	}
+	for _, path := range empties {
+		res, err := MustCompile(path).LookupStrict(json_data)
+		t.Log(path, res, err)
+		if err != nil || fmt.Sprintf("%v", res) != "[]" {
+			t.Errorf("%s exp: [], got: %v, err: %v", path, res, err)
+		}
+	}
+
+	c := MustCompile("$.store.book.isbn")
+	res, _, err := c.Lookup(json_data)
+	if err != nil || len(res.([]interface{})) != 2 {
+		t.Errorf("Lookup should stay lenient, got: %v, err: %v", res, err)
+	}
+	res, err = MustCompile("$.store.book[?(@.isbn)].price").LookupStrict(json_data)
+	if err != nil || fmt.Sprintf("%v", res) != "[8.99 22.99]" {
+		t.Errorf("exp: [8.99 22.99], got: %v, err: %v", res, err)
+	}
+}
+
+func Test_jsonpath_eval_filter_quoted_key(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`[
+		{"id": 1, "content-type": "json", "a.b": {"c": 3}, "headers": {"x.y": "z"}},
+		{"id": 2, "content-type": "xml", "a.b": {"c": 1}, "headers": {"x.y": "w"}}
+	]`), &obj)
+
+	tcases := map[string]string{
+		"$[?(@['content-type'] == 'json')].id": "[1]",
+		"$[?(@['content-type'] != 'json')].id": "[2]",
+		"$[?(@['a.b'].c > 2)].id":              "[1]",
+		"$[?(@.headers['x.y'] == 'w')].id":     "[2]",
+		"$[?(@['a.b'])].id":                    "[1 2]",
+		"$[?(@['a'])].id":                      "[]",
+	}
+	testGet(t, obj, tcases)
+}
+
+func Test_jsonpath_get_idx_on_numeric_keys(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`{"data": {"0": "a", "1": "b"}}`), &obj)
+
+	tcases := map[string]string{
+		"$.data[1]":   "b",
+		"$.data[0,1]": "[a b]",
+		"$.data.1":    "b",
+	}
+	testGet(t, obj, tcases)
+	for _, path := range []string{"$.data[2]", "$.data[-1]"} {
+		if res, err := Get(obj, path); err == nil {
+			t.Errorf("path: %s should fail, got: %v", path, res)
+		}
+	}
+}
+
+func TestWalkAll(t *testing.T) {
+	data := deepCopy(json_data)
+	var redacted []string
+	res, err := WalkAll(data, func(path string, value interface{}) (interface{}, bool) {
+		if s, ok := value.(string); ok && len(s) > 20 {
+			redacted = append(redacted, path)
+			return "[redacted]", true
+		}
+		return nil, false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{"$.store.book[0].title", "$.store.book[3].title"}
+	if !reflect.DeepEqual(redacted, exp) {
+		t.Errorf("exp redacted: %v, got: %v", exp, redacted)
+	}
+	titles, _ := Get(res, "$.store.book[*].title")
+	if fmt.Sprint(titles.Value()) != "[[redacted] Sword of Honour Moby Dick [redacted]]" {
+		t.Errorf("unexpected titles: %v", titles.Value())
+	}
+	if title, _ := Get(json_data, "$.store.book[0].title"); title.Value() != "Sayings of the Century" {
+		t.Errorf("original should be untouched, got: %v", title.Value())
+	}
+
+	// parents are visited before their children, and replaced nodes aren't entered
+	var paths []string
+	WalkAll(map[string]interface{}{"b": []interface{}{1, 2}, "a": map[string]interface{}{"c": 3}},
+		func(path string, value interface{}) (interface{}, bool) {
+			paths = append(paths, path)
+			return "x", path == "$.a"
+		})
+	if exp := []string{"$", "$.a", "$.b", "$.b[0]", "$.b[1]"}; !reflect.DeepEqual(paths, exp) {
+		t.Errorf("exp order: %v, got: %v", exp, paths)
+	}
+
+	// replacing the root returns the new value
+	if res, _ := WalkAll(1, func(string, interface{}) (interface{}, bool) { return 2, true }); res != 2 {
+		t.Errorf("exp 2, got: %v", res)
+	}
+
+	// a typed slice only takes values of its element type
+	_, err = WalkAll([]string{"a"}, func(path string, value interface{}) (interface{}, bool) {
+		return 1, path == "$[0]"
+	})
+	if !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("exp ErrTypeMismatch, got: %v", err)
+	}
+}
+
+func Test_jsonpath_eval_filter_ordering(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`[
+		{"id": 1, "status": "done"},
+		{"id": 2, "status": "pending"},
+		{"id": 3, "status": "active"},
+		{"id": 4, "status": "unknown"}
+	]`), &obj)
+
+	// lexically, "done" < "pending"
+	res, err := Get(obj, "$[?(@.status > 'pending')].id")
+	if err != nil || fmt.Sprint(res.Value()) != "[4]" {
+		t.Errorf("exp lexical order [4], got: %v, err: %v", res, err)
+	}
+
+	RegisterOrdering("status", []string{"pending", "active", "done"})
+	defer RegisterOrdering("status", nil)
+
+	tcases := map[string]string{
+		"$[?(@.status > 'pending')].id":  "[1 3]",
+		"$[?(@.status >= 'active')].id":  "[1 3]",
+		"$[?(@.status < 'done')].id":     "[2 3]",
+		"$[?(@.status == 'active')].id":  "[3]",
+		"$[?(@.status > pending)].id":    "[1 3]",
+		"$[?(@.status > 'whatever')].id": "[]",
+	}
+	testGet(t, obj, tcases)
+}
+
+func TestLookupBytes(t *testing.T) {
+	c := MustCompile("$.order.total")
+	res, err := c.LookupBytes([]byte(`{"order": {"id": 1, "total": 12345678901234567890}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := res.Value().(json.Number); !ok || n.String() != "12345678901234567890" {
+		t.Errorf("exp json.Number 12345678901234567890, got: %#v", res.Value())
+	}
+	if _, err := c.LookupBytes([]byte(`{"order": `)); err == nil {
+		t.Errorf("invalid json should fail")
+	}
+	if _, err := c.LookupBytes([]byte(`{"order": {}}`)); err == nil {
+		t.Errorf("missing key should fail")
+	}
+}
+
+func BenchmarkCompiledLookupBytes(b *testing.B) {
+	payloads := make([][]byte, 100)
+	for i := range payloads {
+		payloads[i] = []byte(fmt.Sprintf(`{"user": {"id": %d, "name": "user%d"}, "items": [1, 2, 3]}`, i, i))
+	}
+	c := MustCompile("$.user.name")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.LookupBytes(payloads[i%len(payloads)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`{"users": [
+		{"displayName": "Ann", "name": "ann", "login": "a1"},
+		{"displayName": null, "name": "bob", "login": "b2"},
+		{"login": "c3"}
+	]}`), &obj)
+
+	name := "$.user.displayName | $.user.name | $.user.login"
+	for i, exp := range []string{"Ann", "bob", "c3"} {
+		user, _ := Get(obj, fmt.Sprintf("$.users[%d]", i))
+		res, err := Project(map[string]interface{}{"user": user.Value()}, map[string]string{"name": name}, false)
+		if err != nil || res["name"] != exp {
+			t.Errorf("user %d: exp name %s, got: %v, err: %v", i, exp, res, err)
+		}
+	}
+
+	res, err := Get(obj, "$.users[2].name | $.users[2].login")
+	if err != nil || res.Value() != "c3" {
+		t.Errorf("exp c3, got: %v, err: %v", res, err)
+	}
+	// unlike a union, only the first value is returned
+	res, err = Get(obj, "$.users[*].login | $.users[0].name")
+	if err != nil || fmt.Sprint(res.Value()) != "[a1 b2 c3]" {
+		t.Errorf("exp [a1 b2 c3], got: %v, err: %v", res, err)
+	}
+	if res, err := Get(obj, "$.users[2].name | $.users[2].email"); err == nil {
+		t.Errorf("exp no match, got: %v", res)
+	}
+
+	proj, err := Project(obj, map[string]string{"email": "$.users[2].name | $.users[2].email"}, true)
+	if _, ok := proj["email"]; err != nil || ok {
+		t.Errorf("missing alternatives should be omitted, got: %v, err: %v", proj, err)
+	}
+	if _, err := Project(obj, map[string]string{"x": "$.a | b"}, false); err == nil {
+		t.Errorf("invalid alternative should fail")
+	}
+}
+
+func TestLookupAllPaths(t *testing.T) {
+	matches, err := MustCompile("$..price").LookupAllPaths(json_data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []Match{
+		{"$.store.bicycle.price", 19.95},
+		{"$.store.book[0].price", 8.95},
+		{"$.store.book[1].price", 12.99},
+		{"$.store.book[2].price", 8.99},
+		{"$.store.book[3].price", 22.99},
+	}
+	if !reflect.DeepEqual(matches, exp) {
+		t.Errorf("exp: %v, got: %v", exp, matches)
+	}
+	for _, m := range matches {
+		if res, err := Get(json_data, m.Path); err != nil || res.Value() != m.Value {
+			t.Errorf("%s: exp %v, got: %v, err: %v", m.Path, m.Value, res, err)
+		}
+	}
+
+	matches, err = MustCompile("$.store.book[?(@.price > 100)]").LookupAllPaths(json_data)
+	if err != nil || len(matches) != 0 {
+		t.Errorf("exp no matches, got: %v, err: %v", matches, err)
+	}
+}
+
+func BenchmarkLookupAllPaths(b *testing.B) {
+	c := MustCompile("$..price")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.LookupAllPaths(json_data)
+	}
+}
+
+// BenchmarkLookupAllPathsNaive resolves the same query without recording
+// paths: every node of the document is tested against it separately, and the
+// value of each matching node is looked up again by its concrete path.
+func BenchmarkLookupAllPathsNaive(b *testing.B) {
+	set, err := NewPathSet("$..price")
+	if err != nil {
+		b.Fatal(err)
+	}
+	naive := func() []Match {
+		matches := make([]Match, 0)
+		WalkAll(json_data, func(path string, value interface{}) (interface{}, bool) {
+			if set.Contains(json_data, path) {
+				res, _ := Get(json_data, path)
+				matches = append(matches, Match{Path: path, Value: res.Value()})
+			}
+			return nil, false
+		})
+		return matches
+	}
+	if exp, _ := MustCompile("$..price").LookupAllPaths(json_data); len(naive()) != len(exp) {
+		b.Fatalf("exp %d matches, got: %v", len(exp), naive())
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		naive()
+	}
+}
+
+// lazyRow is a Getter loading its columns on demand.
+type lazyRow struct {
+	columns map[string]interface{}
+	loaded  []string
+}
+
+func (r *lazyRow) JSONPathGet(key string) (interface{}, bool) {
+	r.loaded = append(r.loaded, key)
+	value, ok := r.columns[key]
+	return value, ok
+}
+
+// getterMap implements Getter on top of a map, which must not be read directly.
+type getterMap map[string]interface{}
+
+func (m getterMap) JSONPathGet(key string) (interface{}, bool) {
+	value, ok := m["_"+key]
+	return value, ok
+}
+
+func TestGetter(t *testing.T) {
+	rows := []interface{}{
+		&lazyRow{columns: map[string]interface{}{"id": 1, "price": 5, "owner": map[string]interface{}{"name": "ann"}}},
+		&lazyRow{columns: map[string]interface{}{"id": 2, "price": 15}},
+	}
+	obj := map[string]interface{}{"rows": rows}
+
+	tcases := map[string]string{
+		"$.rows[0].id":                      "1",
+		"$.rows[0].owner.name":              "ann",
+		"$.rows[*].price":                   "[5 15]",
+		"$.rows[?(@.price > 10)].id":        "[2]",
+		"$.rows[?(@.owner.name == ann)].id": "[1]",
+	}
+	testGet(t, obj, tcases)
+	if res, err := Get(obj, "$.rows[1].owner"); err == nil {
+		t.Errorf("missing key should fail, got: %v", res)
+	}
+	if loaded := rows[0].(*lazyRow).loaded; !strings.Contains(fmt.Sprint(loaded), "id") {
+		t.Errorf("exp keys loaded through JSONPathGet, got: %v", loaded)
+	}
+
+	// the Getter takes precedence over reading the map
+	m := getterMap{"id": 1, "_id": 2}
+	for _, opts := range [][]Option{nil, {CaseInsensitive()}} {
+		res, err := Get(m, "$.id", opts...)
+		if err != nil || res.Value() != 2 {
+			t.Errorf("exp 2 through JSONPathGet, got: %v, err: %v", res, err)
+		}
+	}
+	if matches, err := MustCompile("$.id").LookupAllPaths(m); err != nil || len(matches) != 1 || matches[0].Value != 2 {
+		t.Errorf("exp walk through JSONPathGet, got: %v, err: %v", matches, err)
+	}
+}
+
+func Test_jsonpath_eval_filter_within(t *testing.T) {
+	obj := deepCopy(json_data).(map[string]interface{})
+	obj["priceRange"] = []interface{}{8.0, 13.0}
+	obj["pair"] = []interface{}{8.95, 22.99}
+	obj["names"] = []interface{}{"a", "z"}
+
+	tcases := map[string]string{
+		"$.store.book[?(@.price within $.priceRange)].price": "[8.95 12.99 8.99]",
+		"$.store.book[?(@.price within $.pair)].price":       "[8.95 12.99 8.99 22.99]",
+		// `in` stays a discrete set
+		"$.store.book[?(@.price in $.pair)].price":            "[8.95 22.99]",
+		"$.store.book[?(@.author within $.priceRange)].price": "[]",
+	}
+	testGet(t, obj, tcases)
+
+	for _, path := range []string{
+		"$.store.book[?(@.price within $.expensive)]",
+		"$.store.book[?(@.price within $.names)]",
+	} {
+		if _, err := MustCompile(path).LookupStrict(obj); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("path: %s, exp ErrTypeMismatch, got: %v", path, err)
+		}
+	}
+	if err := ValidatePath("$.store.book[?(@.price within $.priceRange)]"); err != nil {
+		t.Errorf("within should be valid, got: %v", err)
+	}
+}
+
+func TestGetParent(t *testing.T) {
+	res, err := GetParent(json_data, "$.store.book[0].title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	book, ok := res.Value().(map[string]interface{})
+	if !ok || book["author"] != "Nigel Rees" || res.isArray {
+		t.Errorf("exp the first book, got: %v", res.Value())
+	}
+
+	res, err = GetParent(json_data, "$.store.book[1]")
+	if books, ok := res.Value().([]interface{}); err != nil || !ok || len(books) != 4 {
+		t.Errorf("exp the book array, got: %v, err: %v", res, err)
+	}
+	res, err = GetParent(json_data, "$.store.bicycle.color")
+	if err != nil || res.Value().(map[string]interface{})["price"] != 19.95 {
+		t.Errorf("exp the bicycle, got: %v, err: %v", res, err)
+	}
+
+	for _, path := range []string{
+		"$",
+		"$.store.book[*].title",
+		"$.store.book[0,1].title",
+		"$.store.book[?(@.price > 10)].title",
+		"$.store.book.title",
+		"$.store.book[0].isbn",
+		"$.store.nothing",
+	} {
+		if res, err := GetParent(json_data, path); err == nil {
+			t.Errorf("path: %s should fail, got: %v", path, res.Value())
+		}
+	}
+}
+
+func TestLookupWithErrorsCollected(t *testing.T) {
+	results, errs := MustCompile("$.store.book[*].isbn").LookupWithErrorsCollected(json_data)
+	if fmt.Sprint(results) != "[0-553-21311-3 0-395-19395-8]" {
+		t.Errorf("exp the isbns of book 2 and 3, got: %v", results)
+	}
+	if len(errs) != 2 || !strings.HasPrefix(errs[0].Error(), "[0]: ") || !strings.HasPrefix(errs[1].Error(), "[1]: ") {
+		t.Errorf("exp errors for book 0 and 1, got: %v", errs)
+	}
+
+	results, errs = MustCompile("$.store.book[0].price").LookupWithErrorsCollected(json_data)
+	if fmt.Sprint(results) != "[8.95]" || len(errs) != 0 {
+		t.Errorf("exp [8.95] and no errors, got: %v, %v", results, errs)
+	}
+	results, errs = MustCompile("$.store.nothing").LookupWithErrorsCollected(json_data)
+	if len(results) != 0 || len(errs) != 1 {
+		t.Errorf("exp a single error, got: %v, %v", results, errs)
+	}
+}
+
+func TestLookupSharesContainers(t *testing.T) {
+	data := deepCopy(json_data)
+
+	res, err := Get(data, "$.store.book[0]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Value().(map[string]interface{})["price"] = 9.95
+	if price, _ := Get(data, "$.store.book[0].price"); price.Value() != 9.95 {
+		t.Errorf("exp the mutated price 9.95, got: %v", price.Value())
+	}
+
+	res, _ = Get(data, "$.store.book[*]")
+	for i, book := range res.Value().([]interface{}) {
+		if err := Set(book, "$.sale", i%2 == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sales, _ := Get(data, "$.store.book[*].sale"); fmt.Sprint(sales.Value()) != "[true false true false]" {
+		t.Errorf("exp sales set on the document, got: %v", sales.Value())
+	}
+	// the array of a filter is new, the one of a slice is part of the document
+	res, _ = Get(data, "$.store.book[?(@.sale == true)]")
+	res.Value().([]interface{})[0] = nil
+	if book, _ := Get(data, "$.store.book[0]"); book.Value() == nil {
+		t.Errorf("replacing an element of a filter result should not change the document")
+	}
+	res, _ = Get(data, "$.store.book[1:2]")
+	res.Value().([]interface{})[0] = "replaced"
+	if book, _ := Get(data, "$.store.book[1]"); book.Value() != "replaced" {
+		t.Errorf("exp the element replaced in the document, got: %v", book.Value())
+	}
+
+	// elements of typed slices are copies
+	type book struct{ Title string }
+	books := []book{{Title: "a"}}
+	res, _ = Get(books, "$[0]")
+	b := res.Value().(book)
+	b.Title = "b"
+	if books[0].Title != "a" {
+		t.Errorf("exp a copy of the struct, got: %v", books)
+	}
+
+	// GetCopy is independent of the document
+	res, _ = GetCopy(data, "$.store.book[2]")
+	res.Value().(map[string]interface{})["price"] = 0.0
+	if price, _ := Get(data, "$.store.book[2].price"); price.Value() != 8.99 {
+		t.Errorf("exp price 8.99, got: %v", price.Value())
+	}
+}
+
+func Test_jsonpath_eval_filter_regexp_any(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`{
+		"patterns": ["/(?i)^ann/", "bob$"],
+		"invalid": ["^c", 5],
+		"users": [{"name": "Anna"}, {"name": "Bob"}, {"name": "jim-bob"}, {"name": "carl"}, {"id": 5}]
+	}`), &obj)
+
+	tcases := map[string]string{
+		"$.users[?(@.name =~ $.patterns)].name":    "[Anna jim-bob]",
+		"$.users[?(@.name =~ $.patterns[*])].name": "[Anna jim-bob]",
+		"$.users[?(@.name =~ $.patterns[1])].name": "[jim-bob]",
+		// the invalid pattern is never reached for carl
+		"$.users[?(@.name =~ $.invalid)].name": "[carl]",
+	}
+	testGet(t, obj, tcases)
+
+	if _, err := MustCompile("$.users[?(@.name =~ $.invalid)]").LookupStrict(obj); err == nil {
+		t.Errorf("exp an error for the non-string pattern")
+	}
+}
+
+func Test_jsonpath_scan_scoped_to_prefix(t *testing.T) {
+	data := deepCopy(json_data).(map[string]interface{})
+	// a price outside of the store must not be found under `$.store..`
+	data["price"] = 1.0
+
+	tcases := map[string]string{
+		"$.store..color":         "[red]",
+		"$.store..price":         "[19.95 8.95 12.99 8.99 22.99]",
+		"$.store.bicycle..price": "[19.95]",
+		"$.store.book..price":    "[8.95 12.99 8.99 22.99]",
+		"$..price":               "[1 19.95 8.95 12.99 8.99 22.99]",
+		"$.store..book[0].title": "[Sayings of the Century]",
+		"$.store.bicycle.*":      "[red 19.95]",
+	}
+	testGet(t, data, tcases)
+}
+
+func TestSortBy(t *testing.T) {
+	titles := func(books []interface{}) string {
+		res := make([]string, len(books))
+		for i, b := range books {
+			title, _ := b.(map[string]interface{})["title"].(string)
+			res[i] = title
+		}
+		return strings.Join(res, ", ")
+	}
+
+	books, err := SortBy(json_data, "$.store.book[*]", "@.price", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "Sayings of the Century, Moby Dick, Sword of Honour, The Lord of the Rings"; titles(books) != exp {
+		t.Errorf("exp: %s, got: %s", exp, titles(books))
+	}
+	books, _ = SortBy(json_data, "$.store.book", "@.author", false)
+	if exp := "Sayings of the Century, The Lord of the Rings, Moby Dick, Sword of Honour"; titles(books) != exp {
+		t.Errorf("exp: %s, got: %s", exp, titles(books))
+	}
+	// stable, and books without isbn go last
+	books, _ = SortBy(json_data, "$.store.book[*]", "@.isbn", false)
+	if exp := "Moby Dick, The Lord of the Rings, Sayings of the Century, Sword of Honour"; titles(books) != exp {
+		t.Errorf("exp: %s, got: %s", exp, titles(books))
+	}
+
+	if _, err := SortBy(json_data, "$.store.bicycle", "@.price", true); !errors.Is(err, NotSlice) {
+		t.Errorf("exp NotSlice, got: %v", err)
+	}
+}
+
+func TestMaxNodes(t *testing.T) {
+	items := make([]interface{}, 1000)
+	for i := range items {
+		items[i] = map[string]interface{}{"id": i, "tags": []interface{}{"a", "b"}}
+	}
+	wide := map[string]interface{}{"items": items}
+
+	for _, path := range []string{"$..id", "$.items[*].id", "$.items.id"} {
+		c := MustCompile(path, MaxNodes(500))
+		if _, err := c.LookupAllPaths(wide); !errors.Is(err, ErrTooManyNodes) {
+			t.Errorf("%s: exp ErrTooManyNodes walking, got: %v", path, err)
+		}
+		if _, _, err := c.Lookup(wide); !errors.Is(err, ErrTooManyNodes) {
+			t.Errorf("%s: exp ErrTooManyNodes, got: %v", path, err)
+		}
+	}
+
+	// the budget is per lookup
+	c := MustCompile("$.items[*].id", MaxNodes(2000))
+	for i := 0; i < 2; i++ {
+		res, _, err := c.Lookup(wide)
+		if err != nil || len(res.([]interface{})) != 1000 {
+			t.Errorf("exp 1000 ids within the budget, got err: %v", err)
+		}
+	}
+	matches, err := MustCompile("$.items[0].id", MaxNodes(10)).LookupAllPaths(wide)
+	if err != nil || len(matches) != 1 {
+		t.Errorf("exp a narrow query within the budget, got: %v, err: %v", matches, err)
+	}
+
+	// concurrent walks of the same Compiled don't share their budget
+	c = MustCompile("$.items[*].id", MaxNodes(5000))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if matches, err := c.LookupAllPaths(wide); err != nil || len(matches) != 1000 {
+				t.Errorf("exp 1000 ids within the budget, got err: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func Test_jsonpath_eval_filter_bool_number(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`[
+		{"name": "a", "isMan": true, "age": 1},
+		{"name": "b", "isMan": false, "age": 0}
+	]`), &obj)
+
+	tcases := map[string]string{
+		"$[?(@.isMan > 0)].name":     "[]",
+		"$[?(@.isMan >= 0)].name":    "[]",
+		"$[?(@.isMan < 1)].name":     "[]",
+		"$[?(@.isMan == 1)].name":    "[]",
+		"$[?(@.isMan != 1)].name":    "[]",
+		"$[?(@.isMan > @.age)].name": "[]",
+		"$[?(@.isMan == true)].name": "[a]",
+		"$[?(@.age > 0)].name":       "[a]",
+	}
+	testGet(t, obj, tcases)
+}
+
+func TestGetRawRoot(t *testing.T) {
+	raw := json.RawMessage(`{"user": {"name": "ann", "roles": ["admin", "dev"]}}`)
+	for _, root := range []interface{}{raw, []byte(raw), []byte(" \n" + string(raw))} {
+		res, err := Get(root, "$.user.roles[1]")
+		if err != nil || res.Value() != "dev" {
+			t.Errorf("%T: exp dev, got: %v, err: %v", root, res, err)
+		}
+		res, err = Get(root, "$.user.roles[*]")
+		if err != nil || fmt.Sprint(res.Value()) != "[admin dev]" {
+			t.Errorf("%T: exp [admin dev], got: %v, err: %v", root, res, err)
+		}
+		res, err = Get(root, "$")
+		if _, ok := res.Value().(map[string]interface{}); err != nil || !ok {
+			t.Errorf("%T: exp the decoded root, got: %v, err: %v", root, res, err)
+		}
+		paths, err := MustCompile("$..name").LookupAllPaths(root)
+		if err != nil || len(paths) != 1 || paths[0].Value != "ann" {
+			t.Errorf("%T: exp ann, got: %v, err: %v", root, paths, err)
+		}
+	}
+
+	// bytes that aren't a json document stay bytes
+	res, err := Get([]byte("abc"), "$[0]")
+	if err != nil || res.Value() != byte('a') {
+		t.Errorf("exp the first byte, got: %v, err: %v", res, err)
+	}
+	if _, err := Get(json.RawMessage(`{"user": `), "$.user"); err == nil {
+		t.Errorf("exp an error for invalid json")
+	}
+}
+
+func Test_jsonpath_eval_filter_optional_chaining(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`[
+		{"id": 1, "a": {"b": {"c": 5}}},
+		{"id": 2, "a": null},
+		{"id": 3, "a": {"b": null}},
+		{"id": 4},
+		{"id": 5, "a": {"b": {"c": 1}}, "tags": [{"x?.y": 1}]}
+	]`), &obj)
+
+	tcases := map[string]string{
+		"$[?(@?.a?.b?.c > 2)].id":          "[1]",
+		"$[?(@?.a?.b?.c < 2)].id":          "[5]",
+		"$[?(@.a?.b.c)].id":                "[1 5]",
+		"$[?(@?.a?.b?.c == null)].id":      "[]",
+		"$[?(@?.a)].id":                    "[1 3 5]",
+		"$[?(@?.tags[0]['x?.y'] == 1)].id": "[5]",
+	}
+	testGet(t, obj, tcases)
+
+	// the chain stopping at a null is a non-match even for strict lookups
+	res, err := MustCompile("$[?(@?.a?.b?.c > 0)].id").LookupStrict(obj)
+	if err != nil || fmt.Sprint(res) != "[1 5]" {
+		t.Errorf("exp [1 5], got: %v, err: %v", res, err)
+	}
+
+	// an index step on a null or missing array is a non-match as well
+	var items interface{}
+	json.Unmarshal([]byte(`{"items": [
+		{"id": 1, "a": [2, 0]},
+		{"id": 2, "a": null},
+		{"id": 3}
+	]}`), &items)
+	testGet(t, items, map[string]string{
+		"$.items[?(@.a[0] > 1)].id":  "[1]",
+		"$.items[?(@?.a[0] > 1)].id": "[1]",
+		"$.items[?(@.a[0])].id":      "[1]",
+	})
+}
+
+func Test_jsonpath_eval_filter_string_funcs(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`[
+		{"id": 1, "author": " Nigel Rees ", "code": "ab-1"},
+		{"id": 2, "author": "Evelyn Waugh", "code": "AB-2"},
+		{"id": 3, "author": 5, "code": "cd-3"}
+	]`), &obj)
+
+	tcases := map[string]string{
+		"$[?(trim(@.author) == 'Nigel Rees')].id":        "[1]",
+		"$[?(@.author == 'Nigel Rees')].id":              "[]",
+		"$[?(lower(@.code) ^= 'ab')].id":                 "[1 2]",
+		"$[?(upper(@.code) == 'CD-3')].id":               "[3]",
+		"$[?(upper(trim(@.author)) == 'NIGEL REES')].id": "[1]",
+		"$[?(lower(@.author) =~ /^evelyn/)].id":          "[2]",
+		"$[?(@.code == upper('ab-2'))].id":               "[2]",
+	}
+	testGet(t, obj, tcases)
+
+	if _, err := MustCompile("$[?(trim(@.author) == 'x')]").LookupStrict(obj); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("exp ErrTypeMismatch for a number, got: %v", err)
+	}
+}
+
+func TestLookupDistinct(t *testing.T) {
+	res, err := MustCompile("$.store.book[*].category").LookupDistinct(json_data)
+	if err != nil || !reflect.DeepEqual(res, []interface{}{"reference", "fiction"}) {
+		t.Errorf("exp [reference fiction], got: %v, err: %v", res, err)
+	}
+
+	obj := []interface{}{1, 1.0, json.Number("1"), "1", true, nil, nil, map[string]interface{}{}, map[string]interface{}{}, 2}
+	res, err = MustCompile("$[*]").LookupDistinct(obj)
+	if err != nil || fmt.Sprint(res) != "[1 1 true <nil> map[] map[] 2]" {
+		t.Errorf("exp [1 1 true <nil> map[] map[] 2], got: %v, err: %v", res, err)
+	}
+
+	res, err = MustCompile("$.store.bicycle.color").LookupDistinct(json_data)
+	if err != nil || !reflect.DeepEqual(res, []interface{}{"red"}) {
+		t.Errorf("exp [red], got: %v, err: %v", res, err)
+	}
+}
+
+func TestGrowArrays(t *testing.T) {
+	data := map[string]interface{}{"arr": []interface{}{"a"}, "nested": map[string]interface{}{"ids": []int{1}}}
+	if err := Set(data, "$.arr[3]", "d"); err == nil {
+		t.Errorf("exp an error for an index out of range by default")
+	}
+
+	if err := Set(data, "$.arr[3]", "d", GrowArrays()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data["arr"], []interface{}{"a", nil, nil, "d"}) {
+		t.Errorf("exp [a <nil> <nil> d], got: %v", data["arr"])
+	}
+	if err := Set(data, "$.arr[1]", "b", GrowArrays()); err != nil || data["arr"].([]interface{})[1] != "b" {
+		t.Errorf("exp b set in range, got: %v, err: %v", data["arr"], err)
+	}
+	if err := Set(data, "$.nested.ids[2]", 3, GrowArrays()); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := Get(data, "$.nested.ids"); !reflect.DeepEqual(ids.Value(), []int{1, 0, 3}) {
+		t.Errorf("exp [1 0 3], got: %v", ids.Value())
+	}
+	if err := Set(data, "$.nested.ids[4]", "x", GrowArrays()); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("exp ErrTypeMismatch, got: %v", err)
+	}
+
+	type doc struct {
+		Items []string `json:"items"`
+	}
+	d := &doc{Items: []string{"a"}}
+	if err := Set(d, "$.items[2]", "c", GrowArrays()); err != nil || !reflect.DeepEqual(d.Items, []string{"a", "", "c"}) {
+		t.Errorf("exp [a  c], got: %q, err: %v", d.Items, err)
+	}
+
+	// the root array has no holder to write the grown slice back to
+	if err := Set([]interface{}{1}, "$[3]", 4, GrowArrays()); err == nil {
+		t.Errorf("exp an error growing the root")
+	}
+}
+
+func Test_jsonpath_eval_filter_units(t *testing.T) {
+	var obj interface{}
+	json.Unmarshal([]byte(`{
+		"limit": "1MiB",
+		"services": [
+			{"name": "a", "timeout": "500ms", "size": "2MB"},
+			{"name": "b", "timeout": "2s", "size": "512KiB"},
+			{"name": "c", "timeout": "90ms", "size": "1.5 GB"},
+			{"name": "d", "timeout": 1, "size": 100},
+			{"name": "e", "timeout": "soon", "size": "lots"}
+		]
+	}`), &obj)
+
+	tcases := map[string]string{
+		"$.services[?(duration(@.timeout) > '100ms')].name":         "[a b d]",
+		"$.services[?(duration(@.timeout) <= 0.5)].name":            "[a c]",
+		"$.services[?(duration(@.timeout) == '1s')].name":           "[d]",
+		"$.services[?(duration(@.timeout) >= duration('1m'))].name": "[]",
+		"$.services[?(bytes(@.size) < '1MB')].name":                 "[b d]",
+		"$.services[?(bytes(@.size) > 1e9)].name":                   "[c]",
+		"$.services[?(bytes(@.size) <= bytes($.limit))].name":       "[b d]",
+		"$.services[?(bytes(@.size) == '524288')].name":             "[b]",
+	}
+	testGet(t, obj, tcases)
+
+	if _, err := MustCompile("$.services[?(bytes(@.size) > '1XB')]").LookupStrict(obj); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("exp ErrTypeMismatch for an unknown unit, got: %v", err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	book, err := Resolve(json_data, "$.store.book[0]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]interface{}{"title": "Sayings of the Century", "price": 8.95, "author": "Nigel Rees"}
+	for key, value := range exp {
+		n, err := book.Get(key)
+		if err != nil || n.Value() != value {
+			t.Errorf("%s: exp %v, got: %v, err: %v", key, value, n, err)
+			continue
+		}
+		if n.Path() != "$.store.book[0]."+key {
+			t.Errorf("%s: unexpected path %s", key, n.Path())
+		}
+	}
+	if _, err := book.Get("isbn"); err == nil {
+		t.Errorf("exp an error for a missing key")
+	}
+	if _, err := book.Index(0); err == nil {
+		t.Errorf("exp an error indexing an object")
+	}
+
+	books, _ := Resolve(json_data, "$.store.book")
+	last, err := books.Index(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	title, err := last.Get("title")
+	if err != nil || title.Value() != "The Lord of the Rings" || title.Path() != "$.store.book[-1].title" {
+		t.Errorf("exp the last title, got: %v, err: %v", title, err)
+	}
+	if _, err := books.Get("title"); !errors.Is(err, NotMap) {
+		t.Errorf("exp NotMap, got: %v", err)
+	}
+
+	if _, err := Resolve(json_data, "$.store.book[*]"); err == nil {
+		t.Errorf("exp an error for several matches")
+	}
+}
+
+func BenchmarkResolveSiblings(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		book, _ := Resolve(json_data, "$.store.book[0]")
+		for _, key := range []string{"title", "price", "author"} {
+			book.Get(key)
+		}
+	}
+}
+
+func Test_jsonpath_eval_filter_coalesce(t *testing.T) {
+	data := deepCopy(json_data).(map[string]interface{})
+	books := data["store"].(map[string]interface{})["book"].([]interface{})
+	books[1].(map[string]interface{})["discount"] = 2.0
+	books[2].(map[string]interface{})["discount"] = nil
+	books[3].(map[string]interface{})["rebate"] = 1.0
+
+	tcases := map[string]string{
+		// books without a discount count as discount 0
+		"$.store.book[?(coalesce(@.discount, 0) == 0)].title": "[Sayings of the Century Moby Dick The Lord of the Rings]",
+		"$.store.book[?(coalesce(@.discount, 0) > 0)].title":  "[Sword of Honour]",
+		// without coalesce, books without the field are excluded
+		"$.store.book[?(@.rebate >= 0)].title":                           "[The Lord of the Rings]",
+		"$.store.book[?(coalesce(@.discount, @.rebate, 0) > 0)].title":   "[Sword of Honour The Lord of the Rings]",
+		"$.store.book[?(coalesce(@.isbn, 'none') == 'none')].title":      "[Sayings of the Century Sword of Honour]",
+		"$.store.book[?(coalesce(@.discount, null))].title":              "[Sword of Honour]",
+		"$.store.book[?(coalesce(@.discount, $.expensive) >= 10)].title": "[Sayings of the Century Moby Dick The Lord of the Rings]",
+	}
+	testGet(t, data, tcases)
+}